@@ -1,143 +1,4759 @@
 package main
 
 import (
+    "bytes"
+    "compress/gzip"
+    "context"
+    "crypto/tls"
+    "encoding/base64"
     "encoding/json"
+    "errors"
     "fmt"
-    "log"
+    "io"
+    "log/slog"
+    "net"
+    "net/http"
     "net/url"
+    "os"
+    "path"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
     "sync"
+    "sync/atomic"
     "time"
+    "unicode"
 
     "github.com/gorilla/websocket"
 )
 
 type MginDBClient struct {
     uri        string
+    uriErr     error // from NewMginDBClient, returned by every connect
     username   string
     password   string
+    token      string
+    noAuth     bool
     connection *websocket.Conn
+    reader     *reader
+    closed     bool
+    state      atomic.Int32
+    version    atomic.Value // string
+    compressed atomic.Bool
+    lastErr    atomic.Pointer[error]
+    lastClose  atomic.Pointer[DisconnectError]
+    stats      clientStats
     mutex      sync.Mutex
+
+    notifyOnce  sync.Once
+    reconnected chan struct{}
+    failed      chan error
+
+    subMutex      sync.Mutex
+    subscriptions map[string][]*subscription
+    subErr        error
+    resubscribe   bool               // subscriptions outlived a lost connection
+    stopRestore   context.CancelFunc // cancels the latest background redial
+    restores      sync.WaitGroup
+
+    // CommandTimeout bounds the write and the read of every command. The
+    // default of zero means no timeout; WithCallTimeout overrides it for a
+    // single call. A deadline on the call's context applies too, and
+    // whichever comes first ends the call. Set it before the client is used;
+    // SetTimeout changes the timeout safely afterwards.
+    CommandTimeout time.Duration
+
+    // Timeout is the former name of CommandTimeout, used when that is zero.
+    //
+    // Deprecated: use CommandTimeout.
+    Timeout time.Duration
+
+    // ConnectTimeout bounds each connection attempt as a whole, dial and
+    // authentication together, where HandshakeTimeout bounds each of the two
+    // on its own. With a deadline on the context as well, the earliest of
+    // the three wins. Zero means no overall bound.
+    ConnectTimeout time.Duration
+
+    // MaxRetries is how many reconnect attempts are made after a command fails
+    // on a broken connection; an idempotent command is re-sent once after a
+    // successful reconnect (see WithIdempotent). Zero disables reconnection.
+    // RetryDelay is the wait before the second attempt and doubles for each
+    // attempt after that.
+    MaxRetries int
+    RetryDelay time.Duration
+
+    // TLSConfig is used for wss connections, e.g. to trust a private CA or,
+    // through its Certificates, to present a client certificate for mutual
+    // TLS. HandshakeTimeout bounds the whole dial, the TLS and WebSocket
+    // opening handshakes included, and defaults to 10 seconds.
+    TLSConfig        *tls.Config
+    HandshakeTimeout time.Duration
+    certFile         string // from WithClientCert
+    keyFile          string
+
+    // Dialer, when set, is used for proxies, custom NetDial, subprotocols or
+    // buffer sizes. TLSConfig and HandshakeTimeout are merged into a copy of
+    // it, filling TLSClientConfig and HandshakeTimeout only where the Dialer
+    // leaves them unset, and likewise NetDialContext and the buffer sizes
+    // below; the Dialer itself is never modified.
+    Dialer *websocket.Dialer
+
+    // NetDialContext, when set, opens the network connection underneath the
+    // WebSocket in place of a TCP dial to the URI's host and port, which then
+    // only name the server in the handshake. See WithUnixSocket.
+    NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+    // ReadBufferSize and WriteBufferSize size the connection's I/O buffers in
+    // bytes. Zero uses gorilla's default of 4096. Larger buffers cut the
+    // number of reads and writes for big Query results at the cost of that
+    // much memory per connection, pooled clients included; messages larger
+    // than the buffer still work, just in more pieces.
+    ReadBufferSize  int
+    WriteBufferSize int
+
+    // ReadLimit caps the size in bytes of a message read from the server.
+    // Zero, the default, leaves messages unlimited. A message over the limit
+    // cannot be skipped: the connection is closed and the command waiting on
+    // it fails with ErrMessageTooLarge, so set it above the largest Query
+    // result you expect rather than at the typical one.
+    ReadLimit int64
+
+    // EnableCompression offers permessage-deflate during the handshake.
+    // Compression trades CPU on both ends for bandwidth, which pays off for
+    // large JSON query results over slow links and rarely for small
+    // commands. Compressed reports whether the server accepted it.
+    EnableCompression bool
+
+    // OnHandlerPanic, when set, is told about panics recovered from OnMessage
+    // handlers. The reader keeps running either way.
+    OnHandlerPanic func(key string, err error)
+
+    // Backpressure decides what happens to an update for a subscription
+    // channel that is full. The one reader serves every subscription and
+    // every command reply, so with Block a consumer that falls behind stalls
+    // all of them; the drop policies keep the client responsive at the cost
+    // of updates, counted in Stats().Dropped. DropOldest, the default, keeps
+    // the most recent state; DropNewest keeps the backlog in order. It covers
+    // Subscribe, SubscribeMulti and the channels built on them; OnMessage
+    // handlers run on the reader itself and are not affected.
+    Backpressure BackpressurePolicy
+
+    // KeepAlive is the interval between WebSocket pings. A pong must arrive
+    // within one interval or the connection is treated as dead and replaced on
+    // the next command. Zero, the default, disables pings.
+    KeepAlive time.Duration
+
+    // OnCommand, when set, is called after every single command with how long
+    // it took and the error it returned, if any. It runs with no lock held,
+    // on the caller's goroutine or, for the Async methods, on the one that
+    // calls the callback. Pipeline batches are not reported.
+    OnCommand func(cmd string, duration time.Duration, err error)
+
+    // OnCommandContext is OnCommand with the context the command was issued
+    // with, from which a tracer can take the caller's trace and span, e.g.
+    // trace.SpanFromContext(ctx) with OpenTelemetry. The server accepts no
+    // per-command metadata, so trace context goes no further than this hook.
+    // Commands issued without a context get context.Background().
+    OnCommandContext func(ctx context.Context, cmd string, duration time.Duration, err error)
+
+    // Logger receives connection events: connects, authentication results,
+    // reconnect attempts and unexpected disconnects. Nil discards them.
+    Logger Logger
+
+    // KeyValidator, when set, is applied to keys after the built-in check
+    // that rejects empty keys, keys the server would split - those
+    // containing whitespace or "|" - and keys containing "-f", which the
+    // server strips from every command. Its error is wrapped in ErrInvalidKey.
+    KeyValidator func(key string) error
+
+    // CredentialsProvider, when set, is called for the credentials on every
+    // connect and reconnect instead of using the static ones, so rotated or
+    // short-lived secrets are picked up. It runs with the client locked and
+    // must not issue commands on it.
+    CredentialsProvider func() (username, password string, err error)
+
+    // WelcomeMatcher, when set, decides whether the server's first message
+    // means authentication succeeded, for servers whose greeting differs from
+    // welcomePrefix. A rejected message is returned as an AuthError.
+    WelcomeMatcher func(msg string) bool
+
+    // Marshal and Unmarshal, when set, replace encoding/json for the
+    // authentication message and for the values the JSON helpers encode and
+    // decode: SetJSON, GetJSON, QueryInto and SubscribeJSON. The client's own
+    // parsing of server replies always uses encoding/json.
+    Marshal   func(v interface{}) ([]byte, error)
+    Unmarshal func(data []byte, v interface{}) error
+
+    // MaxInFlight, when positive, caps how many commands may be awaiting
+    // replies at once; a Pipeline batch, however long, counts as one. A
+    // command over the cap waits for a slot, as long as its context allows,
+    // or with InFlightFailFast fails at once with ErrTooManyInFlight. Both are
+    // read when the first command is sent and fixed from then on.
+    MaxInFlight      int
+    InFlightFailFast bool
+
+    // CompressValues has the Set methods store values of CompressMinSize
+    // bytes or more (1024 when zero) gzipped, as base64 text behind the
+    // compressedPrefix marker, whenever that comes out smaller. Get, GetMulti
+    // and SubscribeWithSnapshot undo it; subscription updates, Query results
+    // and every other client see the stored text, so enable it only for keys
+    // that no one else reads.
+    CompressValues  bool
+    CompressMinSize int
+
+    // ProtocolVersion selects the wire format commands are written in. Zero
+    // means ProtocolV1, the only version so far. An unknown version fails
+    // Connect before anything is dialed.
+    ProtocolVersion int
+    codec           commandCodec // for ProtocolVersion, set on connect
+    clk             clock        // nil means realClock; see withClock
+    coalescer       atomic.Pointer[coalescer]
+    timeout         atomic.Pointer[time.Duration] // from SetTimeout
+    inFlightOnce    sync.Once
+    inFlightSlots   chan struct{} // nil without MaxInFlight
+}
+
+// Logger takes a message followed by alternating keys and values, the way
+// slog does. A *slog.Logger satisfies it directly; see NewSlogLogger.
+type Logger interface {
+    Debug(msg string, args ...interface{})
+    Error(msg string, args ...interface{})
+}
+
+// NewSlogLogger adapts l to Logger, falling back to slog.Default when l is nil.
+func NewSlogLogger(l *slog.Logger) Logger {
+    if l == nil {
+        l = slog.Default()
+    }
+    return l
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+func (client *MginDBClient) logger() Logger {
+    if client.Logger == nil {
+        return nopLogger{}
+    }
+    return client.Logger
+}
+
+// clock is what the client measures its own waits with: retry delays,
+// command timeouts, keep-alive intervals and reported durations. Socket
+// deadlines, which the operating system enforces, always use real time.
+type clock interface {
+    Now() time.Time
+    After(d time.Duration) <-chan time.Time
+    NewTimer(d time.Duration) timer
+}
+
+type timer interface {
+    C() <-chan time.Time
+    Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) timer         { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (r realTimer) C() <-chan time.Time { return r.t.C }
+func (r realTimer) Stop() bool          { return r.t.Stop() }
+
+// withClock replaces the real clock, so tests can advance time themselves.
+func withClock(c clock) Option {
+    return func(client *MginDBClient) {
+        client.clk = c
+    }
+}
+
+func (client *MginDBClient) clock() clock {
+    if client.clk == nil {
+        return realClock{}
+    }
+    return client.clk
+}
+
+type ConnectionState int32
+
+const (
+    Disconnected ConnectionState = iota
+    Connecting
+    Connected
+    Closed
+)
+
+func (s ConnectionState) String() string {
+    switch s {
+    case Disconnected:
+        return "disconnected"
+    case Connecting:
+        return "connecting"
+    case Connected:
+        return "connected"
+    case Closed:
+        return "closed"
+    }
+    return fmt.Sprintf("ConnectionState(%d)", int32(s))
+}
+
+// ErrKeyNotFound is returned by Get when the key holds no value.
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrNotConnected means the client has no connection to use. Commands issued
+// after Close get it as ErrClientClosed.
+var ErrNotConnected = errors.New("not connected")
+
+// ErrClientClosed is returned by commands issued after Close, which never
+// reconnect on their own. Call Connect or Reconnect to use the client again.
+// It wraps ErrNotConnected.
+var ErrClientClosed = fmt.Errorf("client closed: %w", ErrNotConnected)
+
+// ErrInvalidKey is returned, wrapped with the offending key, when a key fails
+// validation. Nothing is sent to the server in that case.
+var ErrInvalidKey = errors.New("invalid key")
+
+// ErrMessageTooLarge is returned, wrapped with the limit, when the server sends
+// a message larger than ReadLimit.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// ErrJobNotFound is returned, wrapped with the ID, by ScheduleRemove when no
+// job is scheduled under it.
+var ErrJobNotFound = errors.New("scheduled job not found")
+
+// ErrInvalidProtocol is returned, wrapped with the protocol, by Connect when
+// NewMginDBClient was given a protocol other than ws or wss.
+var ErrInvalidProtocol = errors.New("invalid protocol")
+
+// ErrTooManyInFlight is returned by commands issued while MaxInFlight others
+// are awaiting replies, if InFlightFailFast is set.
+var ErrTooManyInFlight = errors.New("too many commands in flight")
+
+// ErrFlushNotConfirmed is returned by Flush called without FlushConfirm(true).
+var ErrFlushNotConfirmed = errors.New("flush not confirmed")
+
+// NotNumericError is returned by IncrBy and DecrBy when the key holds
+// something other than an integer.
+type NotNumericError struct {
+    Key   string
+    Value string
+}
+
+func (e *NotNumericError) Error() string {
+    return fmt.Sprintf("value at %s is not an integer: %q", e.Key, e.Value)
+}
+
+// AuthError is returned by Connect when the server rejects the credentials.
+// Message is the server's reply verbatim.
+type AuthError struct {
+    Message string
+}
+
+func (e *AuthError) Error() string {
+    return fmt.Sprintf("failed to authenticate: %s", e.Message)
+}
+
+// HandshakeError is returned by Connect when the network connection was
+// opened but the TLS or WebSocket handshake over it then failed, including by
+// running out of HandshakeTimeout. Failing to reach the server at all is
+// returned as the dial error itself.
+type HandshakeError struct {
+    Err error
+}
+
+func (e *HandshakeError) Error() string {
+    return fmt.Sprintf("handshake failed: %v", e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error {
+    return e.Err
+}
+
+// Timeout reports whether the handshake ran out of time.
+func (e *HandshakeError) Timeout() bool {
+    var netErr net.Error
+    return errors.Is(e.Err, context.DeadlineExceeded) || errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+// AuthTimeoutError is returned by Connect when the server accepted the
+// WebSocket but did not answer the credentials within HandshakeTimeout. The
+// half-open connection is closed.
+type AuthTimeoutError struct {
+    After time.Duration
+}
+
+func (e *AuthTimeoutError) Error() string {
+    return fmt.Sprintf("no authentication reply after %s", e.After.Round(time.Millisecond))
+}
+
+func (e *AuthTimeoutError) Timeout() bool {
+    return true
+}
+
+// QueryError is returned by QueryInto when the server answers a query with
+// a plain-text message instead of JSON results.
+type QueryError struct {
+    Key     string
+    Message string
+}
+
+func (e *QueryError) Error() string {
+    return fmt.Sprintf("query %s: %s", e.Key, e.Message)
+}
+
+// ServerError is returned when the server answers a command with an error:
+// an "ERROR: ..." line or a {"error": ...} object. Replies covering several
+// keys, such as those of SetMulti and DeleteMulti, report failures per line
+// instead and are returned as they are.
+type ServerError struct {
+    Command string
+    Message string
+}
+
+func (e *ServerError) Error() string {
+    return fmt.Sprintf("server error for %s: %s", e.Command, e.Message)
+}
+
+// parseServerError recognizes the two shapes of error reply.
+func parseServerError(command, reply string) *ServerError {
+    if strings.HasPrefix(reply, "ERROR") && !strings.Contains(reply, "\n") {
+        message := strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(reply, "ERROR"), ":"))
+        return &ServerError{Command: commandName(command), Message: message}
+    }
+    if strings.HasPrefix(reply, `{"error"`) {
+        var envelope map[string]string
+        if json.Unmarshal([]byte(reply), &envelope) == nil && len(envelope) == 1 && envelope["error"] != "" {
+            return &ServerError{Command: commandName(command), Message: envelope["error"]}
+        }
+    }
+    return nil
+}
+
+// MalformedReplyError is returned when a reply does not have the shape a
+// typed helper expects.
+type MalformedReplyError struct {
+    Command string
+    Reply   string
+    Err     error
+}
+
+func (e *MalformedReplyError) Error() string {
+    return fmt.Sprintf("malformed %s reply %q: %v", e.Command, e.Reply, e.Err)
+}
+
+func (e *MalformedReplyError) Unwrap() error {
+    return e.Err
+}
+
+// TimeoutError is returned when a command does not complete within its
+// timeout. The connection is dropped and re-established on the next call.
+type TimeoutError struct {
+    Command string
+    After   time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+    return fmt.Sprintf("command %s timed out after %s", e.Command, e.After)
+}
+
+func (e *TimeoutError) Timeout() bool {
+    return true
+}
+
+// DisconnectError is returned to the commands in flight when the server
+// closes the connection with a close frame, as opposed to the connection
+// simply dropping. Code is the WebSocket close code, e.g. 1001 when the server
+// is going away.
+type DisconnectError struct {
+    Code   int
+    Reason string
+}
+
+func (e *DisconnectError) Error() string {
+    if e.Reason == "" {
+        return fmt.Sprintf("server closed the connection (%d)", e.Code)
+    }
+    return fmt.Sprintf("server closed the connection (%d): %s", e.Code, e.Reason)
+}
+
+type CallOption func(*callOptions)
+
+type callOptions struct {
+    timeout        time.Duration
+    idempotent     *bool
+    flushConfirmed bool
+    keepServing    bool
+}
+
+// WithCallTimeout overrides the client's CommandTimeout for a single command.
+// A zero duration disables the timeout for that call.
+func WithCallTimeout(d time.Duration) CallOption {
+    return func(o *callOptions) {
+        o.timeout = d
+    }
+}
+
+// FlushConfirm must be passed to Flush as FlushConfirm(true) for it to run.
+func FlushConfirm(confirm bool) CallOption {
+    return func(o *callOptions) {
+        o.flushConfirmed = confirm
+    }
+}
+
+// ContinueOnError(true) keeps SubscribeAndServe running when its handler
+// returns an error, discarding the error, instead of stopping with it.
+func ContinueOnError(keepServing bool) CallOption {
+    return func(o *callOptions) {
+        o.keepServing = keepServing
+    }
+}
+
+// WithIdempotent overrides whether a single command may be re-sent after a
+// reconnect, for example to allow it for an INCR the caller deduplicates
+// itself, or to forbid it for a SET whose value calls a server-side
+// expression. See idempotentCommands for the default.
+func WithIdempotent(idempotent bool) CallOption {
+    return func(o *callOptions) {
+        o.idempotent = &idempotent
+    }
+}
+
+// idempotentCommands are re-sent after a command breaks the connection,
+// because applying them twice leaves the same state as applying them once.
+// Everything else - INCR and DECR above all, but also INDICES, SCHEDULE,
+// RENAME and the administrative commands - is not, since the server may have
+// executed it before the connection dropped. DEL is included: a repeated
+// delete may answer "ERROR: Key does not exist" but removes nothing more.
+// Idempotency keys cannot make the rest safe: a command is a bare line of
+// text with nowhere to carry one, and the server keeps no record of applied
+// commands to deduplicate against. SET, the write such a key would most often
+// guard, does not need one.
+var idempotentCommands = map[string]bool{
+    "QUERY":     true,
+    "COUNT":     true,
+    "KEYS":      true,
+    "SET":       true,
+    "DEL":       true,
+    "SUB":       true,
+    "UNSUB":     true,
+    "SUBLIST":   true,
+    pingCommand: true,
+}
+
+func (o callOptions) retryable(command string) bool {
+    if o.idempotent != nil {
+        return *o.idempotent
+    }
+    return idempotentCommands[commandName(command)]
+}
+
+// AuthData is the first message on every connection. Empty fields are left
+// out, so a client configured WithToken sends only {"token": ...}.
+type AuthData struct {
+    Username string `json:"username,omitempty"`
+    Password string `json:"password,omitempty"`
+    Token    string `json:"token,omitempty"`
+}
+
+type Option func(*MginDBClient)
+
+func WithCredentials(username, password string) Option {
+    return func(client *MginDBClient) {
+        client.username = username
+        client.password = password
+    }
+}
+
+// WithoutAuth skips authentication: the connection is used for commands as
+// soon as it opens, with nothing sent first and no welcome awaited. It is for
+// servers that have no authentication step at all. The stock MginDB server is
+// not one of them: with no credentials configured it still takes the first
+// message as the login and answers it with its welcome, so against it leave
+// the credentials unset instead, which sends an empty login it accepts.
+func WithoutAuth() Option {
+    return func(client *MginDBClient) {
+        client.noAuth = true
+    }
+}
+
+// WithToken authenticates with a bearer token in place of a username and
+// password, which are then not sent, nor asked of CredentialsProvider. The
+// stock MginDB server only checks a username and password; this is for
+// deployments that front it with, or replace it by, a token-checking one.
+func WithToken(token string) Option {
+    return func(client *MginDBClient) {
+        client.token = token
+    }
+}
+
+func WithCredentialsProvider(provider func() (username, password string, err error)) Option {
+    return func(client *MginDBClient) {
+        client.CredentialsProvider = provider
+    }
+}
+
+func WithWelcomeMatcher(match func(msg string) bool) Option {
+    return func(client *MginDBClient) {
+        client.WelcomeMatcher = match
+    }
+}
+
+// WithTimeout sets CommandTimeout, as does WithCommandTimeout.
+func WithTimeout(d time.Duration) Option {
+    return WithCommandTimeout(d)
+}
+
+func WithCommandTimeout(d time.Duration) Option {
+    return func(client *MginDBClient) {
+        client.CommandTimeout = d
+    }
+}
+
+func WithConnectTimeout(d time.Duration) Option {
+    return func(client *MginDBClient) {
+        client.ConnectTimeout = d
+    }
+}
+
+// WithRetry sets MaxRetries and RetryDelay. WithRetry(0, 0) disables
+// reconnection.
+func WithRetry(maxRetries int, delay time.Duration) Option {
+    return func(client *MginDBClient) {
+        client.MaxRetries = maxRetries
+        client.RetryDelay = delay
+    }
+}
+
+func WithTLSConfig(cfg *tls.Config) Option {
+    return func(client *MginDBClient) {
+        client.TLSConfig = cfg
+    }
+}
+
+// WithClientCert presents the certificate and key in the given PEM files for
+// mutual TLS, in addition to any Certificates in TLSConfig. The files are read
+// on every connect, so a renewed certificate is picked up on reconnect; one
+// that cannot be loaded fails the connect without dialing.
+func WithClientCert(certFile, keyFile string) Option {
+    return func(client *MginDBClient) {
+        client.certFile = certFile
+        client.keyFile = keyFile
+    }
+}
+
+func WithHandshakeTimeout(d time.Duration) Option {
+    return func(client *MginDBClient) {
+        client.HandshakeTimeout = d
+    }
+}
+
+func WithDialer(d *websocket.Dialer) Option {
+    return func(client *MginDBClient) {
+        client.Dialer = d
+    }
+}
+
+func WithNetDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+    return func(client *MginDBClient) {
+        client.NetDialContext = dial
+    }
+}
+
+// WithUnixSocket speaks WebSocket over the Unix domain socket at path instead
+// of TCP, for a server behind a local proxy or sidecar. The host and port
+// passed to NewMginDBClient are still sent in the handshake's Host header.
+func WithUnixSocket(path string) Option {
+    return WithNetDialContext(func(ctx context.Context, _, _ string) (net.Conn, error) {
+        var d net.Dialer
+        return d.DialContext(ctx, "unix", path)
+    })
+}
+
+func WithReadBufferSize(size int) Option {
+    return func(client *MginDBClient) {
+        client.ReadBufferSize = size
+    }
+}
+
+func WithWriteBufferSize(size int) Option {
+    return func(client *MginDBClient) {
+        client.WriteBufferSize = size
+    }
+}
+
+func WithReadLimit(limit int64) Option {
+    return func(client *MginDBClient) {
+        client.ReadLimit = limit
+    }
+}
+
+func WithCompression() Option {
+    return func(client *MginDBClient) {
+        client.EnableCompression = true
+    }
+}
+
+func WithLogger(l Logger) Option {
+    return func(client *MginDBClient) {
+        client.Logger = l
+    }
+}
+
+func WithKeyValidator(validate func(key string) error) Option {
+    return func(client *MginDBClient) {
+        client.KeyValidator = validate
+    }
+}
+
+func WithProtocolVersion(version int) Option {
+    return func(client *MginDBClient) {
+        client.ProtocolVersion = version
+    }
+}
+
+func WithJSON(marshal func(v interface{}) ([]byte, error), unmarshal func(data []byte, v interface{}) error) Option {
+    return func(client *MginDBClient) {
+        client.Marshal = marshal
+        client.Unmarshal = unmarshal
+    }
+}
+
+func WithMaxInFlight(max int) Option {
+    return func(client *MginDBClient) {
+        client.MaxInFlight = max
+    }
+}
+
+func WithCompressValues(minSize int) Option {
+    return func(client *MginDBClient) {
+        client.CompressValues = true
+        client.CompressMinSize = minSize
+    }
+}
+
+func WithBackpressure(policy BackpressurePolicy) Option {
+    return func(client *MginDBClient) {
+        client.Backpressure = policy
+    }
+}
+
+func WithKeepAlive(interval time.Duration) Option {
+    return func(client *MginDBClient) {
+        client.KeepAlive = interval
+    }
+}
+
+// NewMginDBClient creates a client for the server at host and port. protocol
+// is "ws" or "wss"; "http" and "https" are taken to mean those. Any other
+// protocol makes Connect, and every command, fail with ErrInvalidProtocol.
+func NewMginDBClient(protocol, host string, port int, opts ...Option) *MginDBClient {
+    scheme, err := websocketScheme(protocol)
+    uri := fmt.Sprintf("%s://%s:%d", scheme, host, port)
+    client := &MginDBClient{
+        uri:              uri,
+        uriErr:           err,
+        MaxRetries:       3,
+        RetryDelay:       100 * time.Millisecond,
+        HandshakeTimeout: 10 * time.Second,
+    }
+    for _, opt := range opts {
+        opt(client)
+    }
+    return client
+}
+
+func websocketScheme(protocol string) (string, error) {
+    switch strings.ToLower(protocol) {
+    case "ws", "http":
+        return "ws", nil
+    case "wss", "https":
+        return "wss", nil
+    }
+    return protocol, fmt.Errorf("%w %q: want ws or wss", ErrInvalidProtocol, protocol)
+}
+
+// NewMginDBClientFromEnv creates a client configured from the environment:
+// MGINDB_PROTOCOL (default ws), MGINDB_HOST (default 127.0.0.1), MGINDB_PORT
+// (default 6446, the server's own defaults), and MGINDB_USER and MGINDB_PASS
+// (default none). opts are applied after, so they override the environment.
+func NewMginDBClientFromEnv(opts ...Option) (*MginDBClient, error) {
+    port := 6446
+    if value := os.Getenv("MGINDB_PORT"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n <= 0 || n > 65535 {
+            return nil, fmt.Errorf("MGINDB_PORT: invalid port %q", value)
+        }
+        port = n
+    }
+
+    protocol := os.Getenv("MGINDB_PROTOCOL")
+    if protocol == "" {
+        protocol = "ws"
+    }
+    host := os.Getenv("MGINDB_HOST")
+    if host == "" {
+        host = "127.0.0.1"
+    }
+    credentials := WithCredentials(os.Getenv("MGINDB_USER"), os.Getenv("MGINDB_PASS"))
+    return NewMginDBClient(protocol, host, port, append([]Option{credentials}, opts...)...), nil
+}
+
+// NewMginDBClientWithAuth is the original positional constructor.
+//
+// Deprecated: use NewMginDBClient with WithCredentials.
+func NewMginDBClientWithAuth(protocol, host string, port int, username, password string) *MginDBClient {
+    return NewMginDBClient(protocol, host, port, WithCredentials(username, password))
+}
+
+// SetTimeout replaces the command timeout of a client that may be in use;
+// unlike assigning CommandTimeout, it is safe while other goroutines send
+// commands. Once called it takes precedence over CommandTimeout and Timeout.
+func (client *MginDBClient) SetTimeout(d time.Duration) {
+    client.timeout.Store(&d)
+}
+
+func (client *MginDBClient) commandTimeout() time.Duration {
+    if d := client.timeout.Load(); d != nil {
+        return *d
+    }
+    if client.CommandTimeout > 0 {
+        return client.CommandTimeout
+    }
+    return client.Timeout
+}
+
+// Connect dials and authenticates. It does nothing if the client is already
+// connected; use Reconnect to replace a working connection.
+func (client *MginDBClient) Connect() error {
+    return client.connect(context.Background())
+}
+
+func (client *MginDBClient) connect(ctx context.Context) error {
+    client.mutex.Lock()
+    defer client.mutex.Unlock()
+
+    if client.connection != nil {
+        if !client.reader.isDone() {
+            return nil
+        }
+        client.dropConnection()
+    }
+    if err := client.connectLocked(ctx); err != nil {
+        return err
+    }
+    client.closed = false
+    return nil
+}
+
+// Clone returns a new, disconnected client with the same configuration: the
+// address, credentials and every setting, coalescing included. Connection,
+// subscriptions, counters and errors start afresh, so the clone can serve,
+// say, subscriptions on a connection of their own. Hooks such as OnCommand
+// and Logger are shared, not copied.
+func (client *MginDBClient) Clone() *MginDBClient {
+    client.mutex.Lock()
+    defer client.mutex.Unlock()
+
+    clone := &MginDBClient{
+        uri:      client.uri,
+        uriErr:   client.uriErr,
+        username: client.username,
+        password: client.password,
+        token:    client.token,
+        noAuth:   client.noAuth,
+        certFile: client.certFile,
+        keyFile:  client.keyFile,
+        clk:      client.clk,
+
+        CommandTimeout:      client.CommandTimeout,
+        Timeout:             client.Timeout,
+        ConnectTimeout:      client.ConnectTimeout,
+        MaxRetries:          client.MaxRetries,
+        RetryDelay:          client.RetryDelay,
+        TLSConfig:           client.TLSConfig,
+        HandshakeTimeout:    client.HandshakeTimeout,
+        Dialer:              client.Dialer,
+        NetDialContext:      client.NetDialContext,
+        ReadBufferSize:      client.ReadBufferSize,
+        WriteBufferSize:     client.WriteBufferSize,
+        ReadLimit:           client.ReadLimit,
+        EnableCompression:   client.EnableCompression,
+        OnHandlerPanic:      client.OnHandlerPanic,
+        Backpressure:        client.Backpressure,
+        KeepAlive:           client.KeepAlive,
+        OnCommand:           client.OnCommand,
+        OnCommandContext:    client.OnCommandContext,
+        Logger:              client.Logger,
+        KeyValidator:        client.KeyValidator,
+        CredentialsProvider: client.CredentialsProvider,
+        WelcomeMatcher:      client.WelcomeMatcher,
+        Marshal:             client.Marshal,
+        Unmarshal:           client.Unmarshal,
+        MaxInFlight:         client.MaxInFlight,
+        InFlightFailFast:    client.InFlightFailFast,
+        CompressValues:      client.CompressValues,
+        CompressMinSize:     client.CompressMinSize,
+        ProtocolVersion:     client.ProtocolVersion,
+    }
+    if client.TLSConfig != nil {
+        clone.TLSConfig = client.TLSConfig.Clone()
+    }
+    if c := client.coalescer.Load(); c != nil {
+        clone.EnableCoalescing(c.window)
+    }
+    if d := client.timeout.Load(); d != nil {
+        clone.timeout.Store(d)
+    }
+    return clone
+}
+
+// Reconnect closes the current connection, if any, and dials a new one.
+// Subscriptions carry over to the new connection as they do after a lost one,
+// which requires MaxRetries to be positive.
+func (client *MginDBClient) Reconnect() error {
+    client.mutex.Lock()
+    defer client.mutex.Unlock()
+
+    if r := client.reader; client.connection != nil {
+        client.closeHandshake()
+        client.dropConnection()
+        // Once the old reader is done it has settled what happens to the
+        // subscriptions, so it cannot undo the resubscription below.
+        <-r.done
+    }
+
+    client.subMutex.Lock()
+    if len(client.subscriptions) > 0 {
+        client.resubscribe = true
+    }
+    client.subMutex.Unlock()
+
+    if err := client.connectLocked(context.Background()); err != nil {
+        return err
+    }
+    client.closed = false
+    return nil
+}
+
+// maxWaitDelay caps the backoff between WaitForConnection attempts.
+const maxWaitDelay = 5 * time.Second
+
+// WaitForConnection connects, retrying with backoff from RetryDelay up to
+// maxWaitDelay until it succeeds or ctx ends, for services that start
+// alongside the server. Rejected credentials are returned at once since
+// retrying cannot fix them. When ctx ends first, the error wraps both the
+// context error and the last dial error.
+func (client *MginDBClient) WaitForConnection(ctx context.Context) error {
+    delay := client.RetryDelay
+    if delay <= 0 {
+        delay = 100 * time.Millisecond
+    }
+
+    var lastErr error
+    for {
+        client.mutex.Lock()
+        var err error
+        if client.connection == nil || client.reader.isDone() {
+            if client.connection != nil {
+                client.dropConnection()
+            }
+            err = client.connectLocked(ctx)
+        }
+        if err == nil {
+            client.closed = false
+        }
+        client.mutex.Unlock()
+
+        var authErr *AuthError
+        if err == nil || errors.As(err, &authErr) {
+            return err
+        }
+        if ctx.Err() == nil || lastErr == nil {
+            lastErr = err
+        }
+
+        timer := client.clock().NewTimer(delay)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return fmt.Errorf("%w: last dial error: %w", ctx.Err(), lastErr)
+        case <-timer.C():
+        }
+        delay = min(delay*2, maxWaitDelay)
+    }
+}
+
+// connectLocked dials, authenticates and starts the reader. It must be called
+// with the mutex held: Connect, the lazy connect in submit and reconnect all
+// go through it, so concurrent first commands on a cold client dial once and
+// the rest find the connection in place.
+func (client *MginDBClient) connectLocked(ctx context.Context) error {
+    if client.uriErr != nil {
+        return client.uriErr
+    }
+    codec, err := lookupCodec(client.ProtocolVersion)
+    if err != nil {
+        return err
+    }
+    client.codec = codec
+
+    client.setState(Connecting)
+    client.logger().Debug("mgindb: connecting", "uri", client.uri)
+
+    if client.ConnectTimeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, client.ConnectTimeout)
+        defer cancel()
+    }
+
+    c, hs, err := client.dial(ctx)
+    if err != nil {
+        client.setState(Disconnected)
+        client.setLastError(err)
+        var authErr *AuthError
+        if errors.As(err, &authErr) {
+            client.logger().Error("mgindb: authentication failed", "uri", client.uri, "error", err)
+        } else {
+            client.logger().Error("mgindb: connect failed", "uri", client.uri, "error", err)
+        }
+        return err
+    }
+
+    client.setLastError(nil)
+    if client.stats.connects.Add(1) > 1 {
+        client.notifyOnce.Do(client.initNotify)
+        select {
+        case client.reconnected <- struct{}{}:
+        default:
+        }
+    }
+    client.connection = c
+    client.reader = client.startReader(c)
+    client.version.Store(hs.version)
+    client.compressed.Store(hs.compressed)
+    client.setState(Connected)
+    client.logger().Debug("mgindb: connected", "uri", client.uri, "version", hs.version)
+
+    if err := client.resubscribeAll(); err != nil {
+        client.dropConnection()
+        return err
+    }
+    return nil
+}
+
+// resubscribeAll sends SUB for every key still subscribed from a lost
+// connection. It must be called with the mutex held, right after connecting,
+// so its reply is queued ahead of any command's.
+func (client *MginDBClient) resubscribeAll() error {
+    client.subMutex.Lock()
+    var keys []string
+    if client.resubscribe {
+        for key := range client.subscriptions {
+            keys = append(keys, key)
+        }
+        client.resubscribe = false
+    }
+    client.subMutex.Unlock()
+    if len(keys) == 0 {
+        return nil
+    }
+    sort.Strings(keys)
+    client.logger().Debug("mgindb: resubscribing", "uri", client.uri, "keys", keys)
+
+    r := client.reader
+    r.mutex.Lock()
+    r.pending = append(r.pending, &pendingReply{ch: make(chan []byte, 1)})
+    r.mutex.Unlock()
+
+    if timeout := client.commandTimeout(); timeout > 0 {
+        client.connection.SetWriteDeadline(time.Now().Add(timeout))
+        defer client.connection.SetWriteDeadline(time.Time{})
+    }
+    err := client.connection.WriteMessage(websocket.TextMessage, client.codec.encode(subCommand(strings.Join(keys, ","))))
+    if err != nil {
+        client.logger().Error("mgindb: resubscribe failed", "uri", client.uri, "error", err)
+        client.subMutex.Lock()
+        client.resubscribe = true
+        client.subMutex.Unlock()
+    }
+    return err
+}
+
+// restore redials in the background after a connection carrying
+// subscriptions is lost, so their updates resume without waiting for the next
+// command. If it gives up, the subscriptions are closed. It holds the mutex
+// only for each attempt, not across the backoff between them, so commands and
+// Close are not held up by an outage; Close cancels ctx.
+func (client *MginDBClient) restore(ctx context.Context) {
+    err := client.redial(ctx)
+    if err == nil {
+        return
+    }
+
+    client.subMutex.Lock()
+    if !errors.Is(err, ErrNotConnected) {
+        client.subErr = err
+    }
+    client.resubscribe = false
+    client.closeSubscriptions()
+    client.subMutex.Unlock()
+}
+
+func (client *MginDBClient) redial(ctx context.Context) error {
+    var err error
+    delay := client.RetryDelay
+    for attempt := 0; attempt < client.MaxRetries; attempt++ {
+        if attempt > 0 {
+            timer := client.clock().NewTimer(delay)
+            select {
+            case <-ctx.Done():
+                timer.Stop()
+                return ErrClientClosed
+            case <-timer.C():
+            }
+            delay *= 2
+        }
+
+        client.mutex.Lock()
+        switch {
+        case client.closed || ctx.Err() != nil:
+            err = ErrClientClosed
+        case client.connection != nil && !client.reader.isDone():
+            // A command reconnected in the meantime.
+            err = nil
+        default:
+            client.logger().Debug("mgindb: reconnecting", "uri", client.uri, "attempt", attempt+1, "max", client.MaxRetries)
+            if client.connection != nil {
+                client.dropConnection()
+            }
+            err = client.connectLocked(ctx)
+        }
+        client.mutex.Unlock()
+        if err == nil || errors.Is(err, ErrClientClosed) {
+            return err
+        }
+    }
+    client.notifyFailed(err)
+    return err
+}
+
+// ProtocolV1 is the space-delimited text syntax, e.g. "SET key value", that
+// current servers accept.
+const ProtocolV1 = 1
+
+// commandCodec turns a command from the text form every command method builds
+// into the message written for one protocol version.
+type commandCodec interface {
+    encode(command string) []byte
+}
+
+type textCodec struct{}
+
+func (textCodec) encode(command string) []byte {
+    return []byte(command)
+}
+
+var codecs = map[int]commandCodec{
+    ProtocolV1: textCodec{},
+}
+
+func lookupCodec(version int) (commandCodec, error) {
+    if version == 0 {
+        version = ProtocolV1
+    }
+    codec, ok := codecs[version]
+    if !ok {
+        return nil, fmt.Errorf("unsupported protocol version %d", version)
+    }
+    return codec, nil
+}
+
+// welcomePrefix starts the message the server sends once authenticated.
+// Anything after it, such as a version number, is informational.
+const welcomePrefix = "MginDB server connected... Welcome!"
+
+var versionPattern = regexp.MustCompile(`\d+(\.\d+)+[\w.+-]*`)
+
+// handshake is what dial learned about the connection it opened.
+type handshake struct {
+    version    string // from the welcome message, if it carried one
+    compressed bool   // permessage-deflate was negotiated
+}
+
+// dial opens the socket and authenticates. The returned connection has not
+// been read from beyond the welcome message.
+func (client *MginDBClient) dial(ctx context.Context) (*websocket.Conn, handshake, error) {
+    u, err := url.Parse(client.uri)
+    if err != nil {
+        return nil, handshake{}, err
+    }
+
+    authData := AuthData{Username: client.username, Password: client.password}
+    if client.token != "" {
+        authData = AuthData{Token: client.token}
+    } else if client.CredentialsProvider != nil {
+        authData.Username, authData.Password, err = client.CredentialsProvider()
+        if err != nil {
+            return nil, handshake{}, fmt.Errorf("credentials provider: %w", err)
+        }
+    }
+
+    d := client.dialer()
+    if client.certFile != "" {
+        cert, err := tls.LoadX509KeyPair(client.certFile, client.keyFile)
+        if err != nil {
+            return nil, handshake{}, fmt.Errorf("load client certificate: %w", err)
+        }
+        cfg := &tls.Config{}
+        if d.TLSClientConfig != nil {
+            cfg = d.TLSClientConfig.Clone()
+        }
+        cfg.Certificates = append(cfg.Certificates, cert)
+        d.TLSClientConfig = cfg
+    }
+
+    // Whether the network dial succeeded tells a handshake failure apart from
+    // failing to reach the server.
+    var reached atomic.Bool
+    netDial := d.NetDialContext
+    if netDial == nil {
+        if dial := d.NetDial; dial != nil {
+            netDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+                return dial(network, addr)
+            }
+        } else {
+            netDial = (&net.Dialer{}).DialContext
+        }
+    }
+    d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+        conn, err := netDial(ctx, network, addr)
+        if err == nil {
+            reached.Store(true)
+        }
+        return conn, err
+    }
+
+    c, resp, err := d.DialContext(ctx, u.String(), nil)
+    if err != nil {
+        if reached.Load() {
+            err = &HandshakeError{Err: err}
+        }
+        return nil, handshake{}, err
+    }
+    if client.ReadLimit > 0 {
+        c.SetReadLimit(client.ReadLimit)
+    }
+    compressed := strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+    if client.noAuth {
+        return c, handshake{compressed: compressed}, nil
+    }
+
+    authDataJson, err := client.marshal(authData)
+    if err != nil {
+        c.Close()
+        return nil, handshake{}, err
+    }
+
+    // Authentication gets its own HandshakeTimeout, and ctx, once the
+    // handshake is over, so a server that never answers cannot stall Connect.
+    // The deadlines are cleared afterwards: the reader never sets one.
+    start := time.Now()
+    deadline, _ := ctx.Deadline()
+    deadline = earliest(deadline, client.HandshakeTimeout)
+    c.SetWriteDeadline(deadline)
+    c.SetReadDeadline(deadline)
+    stop := context.AfterFunc(ctx, func() {
+        c.SetReadDeadline(time.Now())
+    })
+    defer stop()
+
+    err = c.WriteMessage(websocket.TextMessage, authDataJson)
+    if err != nil {
+        c.Close()
+        return nil, handshake{}, err
+    }
+
+    _, message, err := c.ReadMessage()
+    if err != nil {
+        c.Close()
+        var netErr net.Error
+        if ctx.Err() != nil {
+            return nil, handshake{}, ctx.Err()
+        }
+        if errors.As(err, &netErr) && netErr.Timeout() {
+            return nil, handshake{}, &AuthTimeoutError{After: time.Since(start)}
+        }
+        err = client.readError(err)
+        client.recordDisconnect(err)
+        return nil, handshake{}, err
+    }
+    if !stop() {
+        // ctx ended just as the welcome arrived and its deadline may be set.
+        c.Close()
+        return nil, handshake{}, ctx.Err()
+    }
+    c.SetWriteDeadline(time.Time{})
+    c.SetReadDeadline(time.Time{})
+
+    welcome := string(message)
+    if !client.welcomed(welcome) {
+        c.Close()
+        return nil, handshake{}, &AuthError{Message: welcome}
+    }
+
+    return c, handshake{
+        version:    versionPattern.FindString(strings.TrimPrefix(welcome, welcomePrefix)),
+        compressed: compressed,
+    }, nil
+}
+
+// Compressed reports whether permessage-deflate was negotiated on the latest
+// connection.
+func (client *MginDBClient) Compressed() bool {
+    return client.compressed.Load()
+}
+
+func (client *MginDBClient) welcomed(msg string) bool {
+    if client.WelcomeMatcher != nil {
+        return client.WelcomeMatcher(msg)
+    }
+    return strings.HasPrefix(msg, welcomePrefix)
+}
+
+// ServerVersion returns the version the server announced in its welcome
+// message on the latest connection, or "" if it announced none or the client
+// has not connected yet.
+func (client *MginDBClient) ServerVersion() string {
+    version, _ := client.version.Load().(string)
+    return version
+}
+
+func (client *MginDBClient) setState(state ConnectionState) {
+    client.state.Store(int32(state))
+}
+
+// State reports the connection state without blocking on in-flight commands.
+func (client *MginDBClient) State() ConnectionState {
+    return ConnectionState(client.state.Load())
+}
+
+// IsConnected reports whether the client holds a connection that has not
+// failed since it was established.
+func (client *MginDBClient) IsConnected() bool {
+    return client.State() == Connected
+}
+
+func (client *MginDBClient) dialer() *websocket.Dialer {
+    if client.Dialer != nil {
+        d := *client.Dialer
+        if d.TLSClientConfig == nil {
+            d.TLSClientConfig = client.TLSConfig
+        }
+        if d.HandshakeTimeout == 0 {
+            d.HandshakeTimeout = client.HandshakeTimeout
+        }
+        if d.NetDialContext == nil && d.NetDial == nil {
+            d.NetDialContext = client.NetDialContext
+        }
+        if d.ReadBufferSize == 0 {
+            d.ReadBufferSize = client.ReadBufferSize
+        }
+        if d.WriteBufferSize == 0 {
+            d.WriteBufferSize = client.WriteBufferSize
+        }
+        if client.EnableCompression {
+            d.EnableCompression = true
+        }
+        return &d
+    }
+    return &websocket.Dialer{
+        Proxy:             http.ProxyFromEnvironment,
+        HandshakeTimeout:  client.HandshakeTimeout,
+        TLSClientConfig:   client.TLSConfig,
+        NetDialContext:    client.NetDialContext,
+        ReadBufferSize:    client.ReadBufferSize,
+        WriteBufferSize:   client.WriteBufferSize,
+        EnableCompression: client.EnableCompression,
+    }
+}
+
+// reconnect replaces a failed connection, dialing with exponential backoff:
+// the first attempt is immediate, then RetryDelay, 2*RetryDelay and so on up
+// to MaxRetries attempts. It must be called with the mutex held, and does
+// nothing if another caller has already reconnected.
+func (client *MginDBClient) reconnect(ctx context.Context) error {
+    if client.closed {
+        return ErrClientClosed
+    }
+    if client.connection != nil {
+        if client.reader.isDone() {
+            client.dropConnection()
+        } else {
+            return nil
+        }
+    }
+
+    var err error
+    delay := client.RetryDelay
+    for attempt := 0; attempt < client.MaxRetries; attempt++ {
+        client.logger().Debug("mgindb: reconnecting", "uri", client.uri, "attempt", attempt+1, "max", client.MaxRetries)
+        if attempt > 0 {
+            timer := client.clock().NewTimer(delay)
+            select {
+            case <-ctx.Done():
+                timer.Stop()
+                return ctx.Err()
+            case <-timer.C():
+            }
+            delay *= 2
+        }
+
+        if err = client.connectLocked(ctx); err == nil {
+            return nil
+        }
+    }
+    if err != nil && ctx.Err() == nil {
+        client.notifyFailed(err)
+    }
+    return err
+}
+
+func (client *MginDBClient) notifyFailed(err error) {
+    client.notifyOnce.Do(client.initNotify)
+    select {
+    case client.failed <- err:
+    default:
+    }
+}
+
+func (client *MginDBClient) initNotify() {
+    client.reconnected = make(chan struct{}, 1)
+    client.failed = make(chan error, 1)
+}
+
+// ReconnectNotify returns a channel that receives a value after every
+// successful reconnect, whether automatic or through Connect or Reconnect, so
+// the application can resynchronize state. It holds one pending signal; the
+// client never waits for the consumer, so signals arriving before the last
+// was received are merged into it.
+func (client *MginDBClient) ReconnectNotify() <-chan struct{} {
+    client.notifyOnce.Do(client.initNotify)
+    return client.reconnected
+}
+
+// ReconnectFailed returns a channel that receives the last dial error each
+// time automatic reconnection gives up after MaxRetries attempts. Like
+// ReconnectNotify it holds one value and is sent to without blocking, so
+// failures arriving while it is full are dropped.
+func (client *MginDBClient) ReconnectFailed() <-chan error {
+    client.notifyOnce.Do(client.initNotify)
+    return client.failed
+}
+
+// reader owns every read from one connection. Command replies are handed to
+// the caller blocked in sendCommand, while pushed subscription updates are
+// routed to their subscribers, so the two never race on ReadMessage.
+//
+// The server marks neither replies nor pushes, so they are told apart by
+// shape: a push is a JSON object with exactly the members "key" and "data"
+// (or, for MONITOR sessions, "command" and "sid"), which no reply is. Anything
+// else is a reply and, since replies come back in order, belongs to the
+// oldest waiting command.
+//
+// Every reply is one WebSocket message, with one exception: a QUERY matching
+// more than 1000 rows first sends them as batches, JSON lists of up to 1000,
+// and only then its reply, which is either the full list or, from a sharded
+// master, a note that the results were batched. Nothing marks where those
+// batches end, so submit follows every QUERY with a pingCommand, and all the
+// messages before the ping's reply belong to the query.
+type reader struct {
+    mutex    sync.Mutex
+    pending  []*pendingReply
+    quit     chan struct{}
+    stopOnce sync.Once
+    done     chan struct{}
+    err      error
+    cause    error
+    workers  sync.WaitGroup // readLoop and keepAlive
+}
+
+var (
+    errPongTimeout      = errors.New("keepalive: no pong received")
+    errConnectionClosed = errors.New("connection closed")
+)
+
+// pendingReply is a command waiting on the reader. For a QUERY, parts gathers
+// its batches and reply until the reply to the ping behind it comes in.
+type pendingReply struct {
+    ch    chan []byte
+    query bool
+    parts [][]byte
+}
+
+// batchedResults is a sharded master's reply to a QUERY whose rows were all
+// sent as batches.
+const batchedResults = "Results sent in batches via WebSocket."
+
+// isQueryPart reports whether message, arriving after the first message for a
+// QUERY, is another of its batches or its reply rather than the ping's reply.
+func isQueryPart(message []byte) bool {
+    return bytes.HasPrefix(bytes.TrimSpace(message), []byte("[")) || string(message) == batchedResults
+}
+
+// queryReply turns the messages gathered for a QUERY into its reply: the last
+// one, unless that only says the rows were batched, in which case the batches
+// are joined into the list a single reply would have held.
+func queryReply(parts [][]byte) []byte {
+    last := parts[len(parts)-1]
+    if string(last) != batchedResults {
+        return last
+    }
+    rows := []json.RawMessage{}
+    for _, part := range parts[:len(parts)-1] {
+        var batch []json.RawMessage
+        if err := json.Unmarshal(part, &batch); err != nil {
+            return last
+        }
+        rows = append(rows, batch...)
+    }
+    joined, err := json.Marshal(rows)
+    if err != nil {
+        return last
+    }
+    return joined
+}
+
+type pushMessage struct {
+    Key  string          `json:"key"`
+    Data json.RawMessage `json:"data"`
+}
+
+func (client *MginDBClient) startReader(conn *websocket.Conn) *reader {
+    r := &reader{
+        quit: make(chan struct{}),
+        done: make(chan struct{}),
+    }
+    if client.KeepAlive > 0 {
+        // The handler is installed before the reader starts so it is never
+        // swapped underneath a running ReadMessage.
+        pongs := make(chan struct{}, 1)
+        conn.SetPongHandler(func(string) error {
+            select {
+            case pongs <- struct{}{}:
+            default:
+            }
+            return nil
+        })
+        r.workers.Add(1)
+        go func() {
+            defer r.workers.Done()
+            client.keepAlive(conn, r, pongs, client.KeepAlive)
+        }()
+    }
+    r.workers.Add(1)
+    go func() {
+        defer r.workers.Done()
+        client.readLoop(conn, r)
+    }()
+    return r
+}
+
+func (client *MginDBClient) keepAlive(conn *websocket.Conn, r *reader, pongs <-chan struct{}, interval time.Duration) {
+    for {
+        select {
+        case <-r.done:
+            return
+        case <-client.clock().After(interval):
+        }
+
+        err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval))
+        if err == nil {
+            timer := client.clock().NewTimer(interval)
+            select {
+            case <-pongs:
+                timer.Stop()
+                continue
+            case <-r.done:
+                timer.Stop()
+                return
+            case <-timer.C():
+                err = errPongTimeout
+            }
+        }
+
+        // Closing the socket ends the reader, which reports the cause and
+        // lets the next command reconnect.
+        client.subMutex.Lock()
+        r.cause = err
+        client.subMutex.Unlock()
+        conn.Close()
+        return
+    }
+}
+
+// stop marks the connection as closed on purpose, so the reader does not
+// report the resulting read error as a failure.
+func (r *reader) stop() {
+    r.stopOnce.Do(func() {
+        close(r.quit)
+    })
+}
+
+func (r *reader) isDone() bool {
+    select {
+    case <-r.done:
+        return true
+    default:
+        return false
+    }
+}
+
+// readLoop never sets a read deadline: command timeouts are timers in
+// roundTrip, so a subscription push may arrive after any amount of silence
+// without a stale deadline from an earlier command failing the read.
+func (client *MginDBClient) readLoop(conn *websocket.Conn, r *reader) {
+    for {
+        _, message, err := conn.ReadMessage()
+        if err != nil {
+            err = client.readError(err)
+            client.subMutex.Lock()
+            if r.cause != nil {
+                err = r.cause
+            }
+            lost := true
+            select {
+            case <-r.quit:
+                err = errConnectionClosed
+                lost = false
+            default:
+                client.subErr = err
+                client.setState(Disconnected)
+                client.recordDisconnect(err)
+            }
+            r.err = err
+            restore := client.MaxRetries > 0 && len(client.subscriptions) > 0
+            var ctx context.Context
+            var cancel context.CancelFunc
+            if restore {
+                client.resubscribe = true
+                ctx, cancel = context.WithCancel(context.Background())
+                client.stopRestore = cancel
+                client.restores.Add(1)
+            } else {
+                client.closeSubscriptions()
+            }
+            client.subMutex.Unlock()
+            close(r.done)
+            if lost {
+                client.setLastError(err)
+                client.logger().Error("mgindb: connection lost", "uri", client.uri, "error", err)
+            }
+            if restore {
+                go func() {
+                    defer client.restores.Done()
+                    defer cancel()
+                    client.restore(ctx)
+                }()
+            }
+            return
+        }
+
+        client.stats.bytesRead.Add(int64(len(message)))
+
+        if push, ok := parsePush(message); ok {
+            client.deliver(push)
+            continue
+        }
+        if isMonitorEvent(message) {
+            // Nothing consumes MONITOR output, but it must not be taken
+            // for the reply to the oldest command.
+            continue
+        }
+
+        // The server answers the commands on a connection one at a time and
+        // in order, so each reply belongs to the oldest waiting command. A
+        // reply with nobody waiting for it is dropped.
+        r.mutex.Lock()
+        var waiter chan []byte
+        if len(r.pending) > 0 {
+            head := r.pending[0]
+            if head.query && (len(head.parts) == 0 || isQueryPart(message)) {
+                head.parts = append(head.parts, message)
+            } else {
+                if head.query {
+                    // This is the reply to the ping that fenced the query.
+                    message = queryReply(head.parts)
+                }
+                waiter = head.ch
+                r.pending = r.pending[1:]
+            }
+        }
+        r.mutex.Unlock()
+        if waiter != nil {
+            waiter <- message
+        }
+    }
+}
+
+// readError replaces gorilla's read limit error with ErrMessageTooLarge and
+// a close frame from the server with a DisconnectError. Gorilla also reports
+// a connection that ended without any close frame as a CloseError, with code
+// 1006, and that stays an ordinary connection error; 1005 is only reported
+// for a close frame that carried no status, so it is a DisconnectError.
+func (client *MginDBClient) readError(err error) error {
+    if errors.Is(err, websocket.ErrReadLimit) {
+        return fmt.Errorf("%w: exceeds ReadLimit of %d bytes", ErrMessageTooLarge, client.ReadLimit)
+    }
+    var closeErr *websocket.CloseError
+    if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure {
+        return &DisconnectError{Code: closeErr.Code, Reason: closeErr.Text}
+    }
+    return err
+}
+
+func (client *MginDBClient) recordDisconnect(err error) {
+    var disconnect *DisconnectError
+    if errors.As(err, &disconnect) {
+        client.lastClose.Store(disconnect)
+    }
+}
+
+// LastDisconnect returns the close code and reason from the most recent close
+// frame the server sent, or nil if it has never closed a connection that way.
+// Connections that merely dropped do not replace it.
+func (client *MginDBClient) LastDisconnect() *DisconnectError {
+    return client.lastClose.Load()
+}
+
+// parsePush recognizes the {"key": ..., "data": ...} envelope the server uses
+// to notify subscribers.
+func parsePush(message []byte) (pushMessage, bool) {
+    var push pushMessage
+    fields := envelope(message, "key", "data")
+    if fields == nil || json.Unmarshal(fields["key"], &push.Key) != nil {
+        return push, false
+    }
+    push.Data = fields["data"]
+    return push, true
+}
+
+// isMonitorEvent recognizes the {"command": ..., "sid": ...} envelope sent to
+// sessions that issued MONITOR.
+func isMonitorEvent(message []byte) bool {
+    return envelope(message, "command", "sid") != nil
+}
+
+// envelope decodes message as a JSON object whose members are exactly the
+// given names, or returns nil.
+func envelope(message []byte, names ...string) map[string]json.RawMessage {
+    if !bytes.HasPrefix(bytes.TrimLeft(message, " \t\r\n"), []byte("{")) {
+        return nil
+    }
+    var fields map[string]json.RawMessage
+    if json.Unmarshal(message, &fields) != nil || len(fields) != len(names) {
+        return nil
+    }
+    for _, name := range names {
+        if fields[name] == nil {
+            return nil
+        }
+    }
+    return fields
+}
+
+func (client *MginDBClient) marshal(v interface{}) ([]byte, error) {
+    if client.Marshal != nil {
+        return client.Marshal(v)
+    }
+    return json.Marshal(v)
+}
+
+func (client *MginDBClient) unmarshal(data []byte, v interface{}) error {
+    if client.Unmarshal != nil {
+        return client.Unmarshal(data, v)
+    }
+    return json.Unmarshal(data, v)
+}
+
+func (client *MginDBClient) validateKey(key string) error {
+    if strings.TrimSpace(key) == "" {
+        return fmt.Errorf("%w: empty", ErrInvalidKey)
+    }
+    if strings.ContainsFunc(key, unicode.IsSpace) || strings.Contains(key, "|") {
+        return fmt.Errorf("%w %q: contains whitespace or |", ErrInvalidKey, key)
+    }
+    if strings.Contains(key, "-f") {
+        // The server deletes every "-f" from the command line, so "my-file"
+        // would be stored as "myile".
+        return fmt.Errorf("%w %q: contains -f, which the server strips", ErrInvalidKey, key)
+    }
+    if client.KeyValidator != nil {
+        if err := client.KeyValidator(key); err != nil {
+            if errors.Is(err, ErrInvalidKey) {
+                return err
+            }
+            return fmt.Errorf("%w %q: %w", ErrInvalidKey, key, err)
+        }
+    }
+    return nil
+}
+
+func (client *MginDBClient) sendCommand(ctx context.Context, command string, opts ...CallOption) (string, error) {
+    if client.OnCommand == nil && client.OnCommandContext == nil {
+        return client.sendOne(ctx, command, opts...)
+    }
+    start := client.clock().Now()
+    reply, err := client.sendOne(ctx, command, opts...)
+    client.reportCommand(ctx, command, client.clock().Now().Sub(start), err)
+    return reply, err
+}
+
+func (client *MginDBClient) reportCommand(ctx context.Context, command string, duration time.Duration, err error) {
+    if hook := client.OnCommand; hook != nil {
+        hook(command, duration, err)
+    }
+    if hook := client.OnCommandContext; hook != nil {
+        hook(ctx, command, duration, err)
+    }
+}
+
+func (client *MginDBClient) sendOne(ctx context.Context, command string, opts ...CallOption) (string, error) {
+    replies, err := client.sendCommands(ctx, []string{command}, opts...)
+    if err != nil {
+        return "", err
+    }
+    if serverErr := parseServerError(command, replies[0]); serverErr != nil {
+        client.stats.errors.Add(1)
+        return "", serverErr
+    }
+    return replies[0], nil
+}
+
+// sendCommands writes the commands back to back and collects their replies in
+// order. Replies are matched to commands by position: the server processes a
+// connection's messages sequentially, so the nth reply that is not a
+// subscription push answers the nth command written. The mutex is held only
+// while writing, which keeps a caller's commands contiguous on the wire and
+// lets many goroutines wait for replies on one connection at the same time.
+// Only a lone idempotent command is re-sent after a reconnect: a batch that
+// broke midway may already have been partially applied, and so may a command
+// that is unsafe to apply twice.
+func (client *MginDBClient) sendCommands(ctx context.Context, commands []string, opts ...CallOption) (replies []string, err error) {
+    defer func() {
+        if err != nil {
+            client.stats.errors.Add(1)
+        }
+    }()
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    if err := client.acquireInFlight(ctx); err != nil {
+        return nil, err
+    }
+    defer client.releaseInFlight()
+
+    options := callOptions{timeout: client.commandTimeout()}
+    for _, opt := range opts {
+        opt(&options)
+    }
+
+    replies, broken, err := client.roundTrip(ctx, commands, options)
+    if !broken || client.MaxRetries <= 0 || len(commands) > 1 || !options.retryable(commands[0]) {
+        return replies, err
+    }
+
+    client.mutex.Lock()
+    err = client.reconnect(ctx)
+    client.mutex.Unlock()
+    if err != nil {
+        return nil, err
+    }
+    replies, _, err = client.roundTrip(ctx, commands, options)
+    return replies, err
+}
+
+func (client *MginDBClient) acquireInFlight(ctx context.Context) error {
+    client.inFlightOnce.Do(func() {
+        if client.MaxInFlight > 0 {
+            client.inFlightSlots = make(chan struct{}, client.MaxInFlight)
+        }
+    })
+
+    if slots := client.inFlightSlots; slots != nil {
+        select {
+        case slots <- struct{}{}:
+        default:
+            if client.InFlightFailFast {
+                return ErrTooManyInFlight
+            }
+            select {
+            case slots <- struct{}{}:
+            case <-ctx.Done():
+                return ctx.Err()
+            }
+        }
+    }
+    client.stats.inFlight.Add(1)
+    return nil
+}
+
+func (client *MginDBClient) releaseInFlight() {
+    client.stats.inFlight.Add(-1)
+    if client.inFlightSlots != nil {
+        <-client.inFlightSlots
+    }
+}
+
+// roundTrip writes the commands and waits for the reader to hand back one
+// reply per command, all within a single timeout. broken reports that the
+// connection failed underneath the commands, as opposed to the context ending
+// or the timeout firing, which are never retried.
+func (client *MginDBClient) roundTrip(ctx context.Context, commands []string, options callOptions) ([]string, bool, error) {
+    var r *reader
+    var waiters []chan []byte
+    var broken bool
+    var err error
+    if c := client.coalescer.Load(); c != nil && len(commands) == 1 {
+        r, waiters, broken, err = c.submit(ctx, commands[0])
+    } else {
+        r, waiters, broken, err = client.submit(ctx, commands, options)
+    }
+    if err != nil {
+        return nil, broken, err
+    }
+    return client.await(ctx, r, waiters, commands, options)
+}
+
+// EnableCoalescing holds each single command for up to window so that the
+// commands issued meanwhile, from any number of goroutines, are written in one
+// go under one lock, much as a Pipeline would write them; each caller still
+// gets its own reply. A window of zero or less turns it off again. Every
+// command pays up to window of extra latency, which only pays off when many
+// goroutines write at once. The batch is written with CommandTimeout: a
+// caller's context or WithCallTimeout still bounds its wait for the reply
+// but cannot cut the shared write short. Batches and the Async methods are
+// written as they are.
+func (client *MginDBClient) EnableCoalescing(window time.Duration) {
+    if window <= 0 {
+        client.coalescer.Store(nil)
+        return
+    }
+    client.coalescer.Store(&coalescer{client: client, window: window})
+}
+
+// coalescer collects the commands submitted within one window and writes them
+// with a single client.submit when the window closes.
+type coalescer struct {
+    client *MginDBClient
+    window time.Duration
+    mutex  sync.Mutex
+    queue  []*coalesced
+}
+
+// coalesced is one queued command; done is closed once the batch holding it
+// has been written, or has failed to be.
+type coalesced struct {
+    command string
+    done    chan struct{}
+    r       *reader
+    waiter  chan []byte
+    broken  bool
+    err     error
+}
+
+func (c *coalescer) submit(ctx context.Context, command string) (*reader, []chan []byte, bool, error) {
+    item := &coalesced{command: command, done: make(chan struct{})}
+    c.mutex.Lock()
+    c.queue = append(c.queue, item)
+    if len(c.queue) == 1 {
+        go func() {
+            <-c.client.clock().After(c.window)
+            c.flush()
+        }()
+    }
+    c.mutex.Unlock()
+
+    select {
+    case <-item.done:
+    case <-ctx.Done():
+        // The command goes out with its batch regardless, and its waiter
+        // absorbs the reply.
+        return nil, nil, false, ctx.Err()
+    }
+    if item.err != nil {
+        return nil, nil, item.broken, item.err
+    }
+    return item.r, []chan []byte{item.waiter}, false, nil
+}
+
+func (c *coalescer) flush() {
+    c.mutex.Lock()
+    batch := c.queue
+    c.queue = nil
+    c.mutex.Unlock()
+
+    commands := make([]string, len(batch))
+    for i, item := range batch {
+        commands[i] = item.command
+    }
+    options := callOptions{timeout: c.client.commandTimeout()}
+    r, waiters, broken, err := c.client.submit(context.Background(), commands, options)
+    for i, item := range batch {
+        if err != nil {
+            item.broken, item.err = broken, err
+        } else {
+            item.r, item.waiter = r, waiters[i]
+        }
+        close(item.done)
+    }
+}
+
+// await collects the replies for commands that submit wrote.
+func (client *MginDBClient) await(ctx context.Context, r *reader, waiters []chan []byte, commands []string, options callOptions) ([]string, bool, error) {
+    var expired <-chan time.Time
+    if options.timeout > 0 {
+        timer := client.clock().NewTimer(options.timeout)
+        defer timer.Stop()
+        expired = timer.C()
+    }
+
+    replies := make([]string, 0, len(commands))
+    for i, waiter := range waiters {
+        select {
+        case message := <-waiter:
+            replies = append(replies, string(message))
+            continue
+        case <-r.done:
+            select {
+            case message := <-waiter:
+                replies = append(replies, string(message))
+                continue
+            default:
+            }
+            return nil, true, r.err
+        case <-ctx.Done():
+            // The abandoned waiters stay queued and absorb their replies, so
+            // the connection remains usable for other commands.
+            return nil, false, ctx.Err()
+        case <-expired:
+            client.dropReader(r)
+            err := &TimeoutError{Command: commandName(commands[i]), After: options.timeout}
+            client.setLastError(err)
+            return nil, false, err
+        }
+    }
+    return replies, false, nil
+}
+
+// submit connects if needed, queues one waiter per command on the reader and
+// writes the commands, all under the mutex so the queue order matches the
+// order on the wire.
+func (client *MginDBClient) submit(ctx context.Context, commands []string, options callOptions) (*reader, []chan []byte, bool, error) {
+    client.mutex.Lock()
+    defer client.mutex.Unlock()
+
+    if client.closed {
+        return nil, nil, false, ErrClientClosed
+    }
+    if client.connection != nil && client.reader.isDone() {
+        client.dropConnection()
+    }
+    if client.connection == nil {
+        if err := client.connectLocked(ctx); err != nil {
+            return nil, nil, false, err
+        }
+    }
+    conn, r := client.connection, client.reader
+
+    waiters := make([]chan []byte, len(commands))
+    entries := make([]*pendingReply, len(commands))
+    for i, command := range commands {
+        waiters[i] = make(chan []byte, 1)
+        entries[i] = &pendingReply{ch: waiters[i], query: commandName(command) == "QUERY"}
+    }
+    r.mutex.Lock()
+    r.pending = append(r.pending, entries...)
+    r.mutex.Unlock()
+
+    // A context deadline maps directly onto the write deadline; plain
+    // cancellation forces a pending write to return immediately.
+    // The deadline is cleared once the writes are done so that it cannot
+    // outlive this call on the shared connection.
+    deadline, _ := ctx.Deadline()
+    stop := context.AfterFunc(ctx, func() {
+        conn.SetWriteDeadline(time.Now())
+    })
+
+    conn.SetWriteDeadline(earliest(deadline, options.timeout))
+    for _, command := range commands {
+        if err := conn.WriteMessage(websocket.TextMessage, client.codec.encode(command)); err != nil {
+            stop()
+            broken, err := client.writeError(ctx, command, options.timeout, err)
+            return nil, nil, broken, err
+        }
+        client.stats.commands.Add(1)
+        client.stats.bytesWritten.Add(int64(len(command)))
+        if commandName(command) != "QUERY" {
+            continue
+        }
+        if err := conn.WriteMessage(websocket.TextMessage, client.codec.encode(pingCommand)); err != nil {
+            stop()
+            broken, err := client.writeError(ctx, command, options.timeout, err)
+            return nil, nil, broken, err
+        }
+        client.stats.bytesWritten.Add(int64(len(pingCommand)))
+    }
+    if stop() {
+        conn.SetWriteDeadline(time.Time{})
+    }
+    return r, waiters, false, nil
+}
+
+// earliest returns the sooner of the context deadline and now+timeout, where a
+// zero deadline or timeout means no limit from that source.
+func earliest(deadline time.Time, timeout time.Duration) time.Time {
+    if timeout <= 0 {
+        return deadline
+    }
+    limit := time.Now().Add(timeout)
+    if deadline.IsZero() || limit.Before(deadline) {
+        return limit
+    }
+    return deadline
+}
+
+// writeError drops the connection after a failed write, since a partially
+// written frame leaves it unusable. It must be called with the mutex held.
+func (client *MginDBClient) writeError(ctx context.Context, command string, timeout time.Duration, err error) (bool, error) {
+    client.dropConnection()
+
+    if ctxErr := ctx.Err(); ctxErr != nil {
+        return false, ctxErr
+    }
+
+    var netErr net.Error
+    if errors.As(err, &netErr) && netErr.Timeout() {
+        err = &TimeoutError{Command: commandName(command), After: timeout}
+        client.setLastError(err)
+        return false, err
+    }
+
+    client.setLastError(err)
+    return true, err
+}
+
+func (client *MginDBClient) setLastError(err error) {
+    if err == nil {
+        client.lastErr.Store(nil)
+        return
+    }
+    client.lastErr.Store(&err)
+}
+
+// LastError returns the most recent connection-level failure - a dial or
+// authentication error, a lost connection, a failed write or a timeout that
+// dropped the connection - or nil once a connection has been established
+// since. Errors from the server about individual commands are not recorded.
+func (client *MginDBClient) LastError() error {
+    if err := client.lastErr.Load(); err != nil {
+        return *err
+    }
+    return nil
+}
+
+// ClientStats is a snapshot of a client's activity since it was created.
+type ClientStats struct {
+    Commands     int64 // commands written, including those in batches
+    BytesWritten int64 // command text written
+    BytesRead    int64 // messages read, replies and pushes alike
+    Reconnects   int64 // connections established after the first
+    Errors       int64 // commands and batches that failed, server errors included
+    Dropped      int64 // subscription updates discarded under Backpressure
+    InFlight     int64 // commands and batches awaiting replies right now
+}
+
+type clientStats struct {
+    commands     atomic.Int64
+    bytesWritten atomic.Int64
+    bytesRead    atomic.Int64
+    connects     atomic.Int64
+    errors       atomic.Int64
+    dropped      atomic.Int64
+    inFlight     atomic.Int64
+}
+
+// Stats returns the client's counters without taking any lock. Each counter
+// is read atomically but the set is not, so a command finishing meanwhile may
+// show up in some fields and not yet in others.
+func (client *MginDBClient) Stats() ClientStats {
+    reconnects := client.stats.connects.Load() - 1
+    if reconnects < 0 {
+        reconnects = 0
+    }
+    return ClientStats{
+        Commands:     client.stats.commands.Load(),
+        BytesWritten: client.stats.bytesWritten.Load(),
+        BytesRead:    client.stats.bytesRead.Load(),
+        Reconnects:   reconnects,
+        Errors:       client.stats.errors.Load(),
+        Dropped:      client.stats.dropped.Load(),
+        InFlight:     client.stats.inFlight.Load(),
+    }
+}
+
+// dropReader drops the connection r reads from, unless it has already been
+// replaced.
+func (client *MginDBClient) dropReader(r *reader) {
+    client.mutex.Lock()
+    defer client.mutex.Unlock()
+
+    if client.reader == r {
+        client.dropConnection()
+    }
+}
+
+// closeTimeout bounds the WebSocket close handshake performed by Close.
+const closeTimeout = time.Second
+
+// closeHandshake sends a normal-closure close frame and waits, up to
+// closeTimeout, for the server's close frame to end the reader, so the server
+// sees a clean disconnect rather than a vanished client.
+func (client *MginDBClient) closeHandshake() {
+    conn, r := client.connection, client.reader
+    r.stop()
+
+    message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+    if err := conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(closeTimeout)); err != nil {
+        return
+    }
+
+    timer := client.clock().NewTimer(closeTimeout)
+    defer timer.Stop()
+    select {
+    case <-r.done:
+    case <-timer.C():
+    }
+}
+
+func (client *MginDBClient) dropConnection() error {
+    if client.connection == nil {
+        return nil
+    }
+
+    client.reader.stop()
+    err := client.connection.Close()
+    client.connection = nil
+    client.reader = nil
+    client.setState(Disconnected)
+    return err
+}
+
+func commandName(command string) string {
+    if i := strings.IndexByte(command, ' '); i >= 0 {
+        return command[:i]
+    }
+    return command
+}
+
+func setCommand(key, value string) string {
+    return fmt.Sprintf("SET %s %s", key, quoteValue(value))
+}
+
+// setJSONCommand always sends the document as a string, so the server stores
+// it verbatim instead of decoding objects into data of its own.
+func setJSONCommand(key string, document []byte) string {
+    return fmt.Sprintf("SET %s %s", key, quoteString(string(document)))
+}
+
+// valueEscaper hides, inside a quoted value, the sequences the server acts on
+// before it decodes the value: "|" splits batches, "-f" is stripped from the
+// whole line, "EXPIRE" is read as an expiry instruction and anything shaped
+// like name(arg) is run as an expression function. The \u escapes decode back
+// to the original text.
+var valueEscaper = strings.NewReplacer(
+    "|", `\u007c`,
+    "(", `\u0028`,
+    "-f", `\u002df`,
+    "EXPIRE", `\u0045XPIRE`,
+)
+
+// quoteValue makes a SET value survive the server's parser. The server takes
+// everything after the key up to the end of the line, trims it and decodes it
+// as JSON when it can, so plain values, numbers and JSON objects are passed
+// through untouched. A value the server would alter - one that is empty, has
+// surrounding whitespace, a line break, a leading quote or any of the
+// sequences in valueEscaper - is sent as a JSON string instead, which the
+// server decodes back to exactly the text given.
+func quoteValue(value string) string {
+    if !needsQuoting(value) {
+        return value
+    }
+    return quoteString(value)
+}
+
+func quoteString(value string) string {
+    quoted, _ := json.Marshal(value)
+    return valueEscaper.Replace(string(quoted))
+}
+
+func needsQuoting(value string) bool {
+    return value == "" ||
+        strings.TrimSpace(value) != value ||
+        strings.ContainsAny(value, "\r\n|(") ||
+        strings.HasPrefix(value, `"`) ||
+        strings.Contains(value, "-f") ||
+        strings.Contains(value, "EXPIRE")
+}
+
+// setExCommand appends the server's EXPIRE(seconds) value instruction.
+// Fractional seconds are rounded up so a short ttl never becomes zero.
+func setExCommand(key, value string, ttl time.Duration) string {
+    return fmt.Sprintf("SET %s %s EXPIRE(%d)", key, quoteValue(value), expireSeconds(ttl))
+}
+
+// expireCommand writes value, as JSON, back with an expiry. Outside its
+// strings JSON holds none of the sequences valueEscaper rewrites.
+func expireCommand(key string, value json.RawMessage, ttl time.Duration) string {
+    return fmt.Sprintf("SET %s %s EXPIRE(%d)", key, valueEscaper.Replace(string(value)), expireSeconds(ttl))
+}
+
+func expireSeconds(ttl time.Duration) int64 {
+    return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// setMultiCommand uses the server's "|" separator to set several keys in one
+// SET, ordered by key so the command is deterministic.
+func setMultiCommand(pairs map[string]string) string {
+    keys := make([]string, 0, len(pairs))
+    for key := range pairs {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    var b strings.Builder
+    b.WriteString("SET ")
+    for i, key := range keys {
+        if i > 0 {
+            b.WriteByte('|')
+        }
+        b.WriteString(key)
+        b.WriteByte(' ')
+        b.WriteString(quoteValue(pairs[key]))
+    }
+    return b.String()
+}
+
+// getCommand reads a key through QUERY, which is how the server exposes
+// single-key reads; it has no GET command.
+func getCommand(key string) string {
+    return fmt.Sprintf("QUERY %s", key)
+}
+
+// indicesCommand leaves out empty arguments: the server reads the whole rest
+// of the line as the index path for FLUSH, trailing spaces included.
+func indicesCommand(action, key, value string) string {
+    command := "INDICES " + action
+    for _, arg := range []string{key, value} {
+        if arg != "" {
+            command += " " + arg
+        }
+    }
+    return command
+}
+
+func incrCommand(key, value string) string {
+    return fmt.Sprintf("INCR %s %s", key, value)
+}
+
+func decrCommand(key, value string) string {
+    return fmt.Sprintf("DECR %s %s", key, value)
+}
+
+func deleteCommand(key string) string {
+    return fmt.Sprintf("DEL %s", key)
+}
+
+// deleteMultiCommand uses the server's "|" separator to delete several keys
+// in one DEL.
+func deleteMultiCommand(keys []string) string {
+    return "DEL " + strings.Join(keys, "|")
+}
+
+func queryCommand(key, queryString, options string) string {
+    return fmt.Sprintf("QUERY %s %s %s", key, queryString, options)
+}
+
+func countCommand(key string) string {
+    return fmt.Sprintf("COUNT %s", key)
+}
+
+const keysCommand = "KEYS"
+
+func scheduleCommand(action, cronOrKey, command string) string {
+    return fmt.Sprintf("SCHEDULE %s %s %s", action, cronOrKey, command)
+}
+
+func subCommand(key string) string {
+    return fmt.Sprintf("SUB %s", key)
+}
+
+func unsubCommand(key string) string {
+    return fmt.Sprintf("UNSUB %s", key)
+}
+
+func (client *MginDBClient) Set(key, value string, opts ...CallOption) (string, error) {
+    return client.SetContext(context.Background(), key, value, opts...)
+}
+
+func (client *MginDBClient) SetContext(ctx context.Context, key, value string, opts ...CallOption) (string, error) {
+    if err := client.validateKey(key); err != nil {
+        return "", err
+    }
+    return client.sendCommand(ctx, setCommand(key, client.compress(value)), opts...)
+}
+
+// SetOK is Set reporting whether the server acknowledged the write.
+func (client *MginDBClient) SetOK(key, value string, opts ...CallOption) (bool, error) {
+    return client.SetOKContext(context.Background(), key, value, opts...)
+}
+
+func (client *MginDBClient) SetOKContext(ctx context.Context, key, value string, opts ...CallOption) (bool, error) {
+    reply, err := client.SetContext(ctx, key, value, opts...)
+    if err != nil {
+        return false, err
+    }
+    ok, err := parseAck(reply)
+    if err != nil {
+        return false, &MalformedReplyError{Command: "SET", Reply: reply, Err: err}
+    }
+    return ok, nil
+}
+
+// parseAck is the one place that decides what a write's acknowledgement
+// means: "OK", "1" and "true" that it took effect, "0" and "false" that it
+// did not, and "Deleted N entries." that it did if N is positive. Anything
+// else, an error reply included, is an error.
+func parseAck(reply string) (bool, error) {
+    switch strings.ToLower(strings.TrimSpace(reply)) {
+    case "ok", "1", "true":
+        return true, nil
+    case "0", "false":
+        return false, nil
+    }
+    var n int
+    if _, err := fmt.Sscanf(reply, "Deleted %d entries.", &n); err == nil {
+        return n > 0, nil
+    }
+    return false, fmt.Errorf("unrecognized acknowledgement %q", reply)
+}
+
+// SetNX sets key to value only if key holds nothing, reporting whether it
+// did. The server has no conditional write, so this is Exists followed by Set:
+// another client can set the key in between and be overwritten, which makes
+// SetNX unsuitable as a lock between competing writers.
+func (client *MginDBClient) SetNX(key, value string, opts ...CallOption) (bool, error) {
+    return client.SetNXContext(context.Background(), key, value, opts...)
+}
+
+func (client *MginDBClient) SetNXContext(ctx context.Context, key, value string, opts ...CallOption) (bool, error) {
+    exists, err := client.ExistsContext(ctx, key, opts...)
+    if err != nil || exists {
+        return false, err
+    }
+    if _, err := client.SetContext(ctx, key, value, opts...); err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+// GetSet sets key to value and returns the value it held before. If it held
+// nothing, the write still happens and the error is ErrKeyNotFound, so an
+// empty previous value is told apart from none. The server has no swap
+// command: the read and the write go out together and run back to back on
+// this connection, but a write from another client can land between them.
+func (client *MginDBClient) GetSet(key, value string, opts ...CallOption) (old string, err error) {
+    return client.GetSetContext(context.Background(), key, value, opts...)
+}
+
+func (client *MginDBClient) GetSetContext(ctx context.Context, key, value string, opts ...CallOption) (old string, err error) {
+    if err := client.validateKey(key); err != nil {
+        return "", err
+    }
+
+    replies, err := client.sendCommands(ctx, []string{getCommand(key), setCommand(key, client.compress(value))}, opts...)
+    if err != nil {
+        return "", err
+    }
+    if ok, _ := parseAck(replies[1]); !ok {
+        return "", fmt.Errorf("SET %s: %s", key, replies[1])
+    }
+
+    old, err = parseGetReply(key, replies[0])
+    return decompress(old), err
+}
+
+// SetEx sets key to value and has the server delete it after ttl. Expiry is
+// the server's native EXPIRE instruction, which its scheduler enforces: with
+// the scheduler off (CONFIG SET SCHEDULER 1 enables it) the server refuses the
+// command and says so in the reply.
+func (client *MginDBClient) SetEx(key, value string, ttl time.Duration, opts ...CallOption) (string, error) {
+    return client.SetExContext(context.Background(), key, value, ttl, opts...)
+}
+
+func (client *MginDBClient) SetExContext(ctx context.Context, key, value string, ttl time.Duration, opts ...CallOption) (string, error) {
+    if ttl <= 0 {
+        return "", fmt.Errorf("ttl must be positive, got %s", ttl)
+    }
+    if err := client.validateKey(key); err != nil {
+        return "", err
+    }
+    return client.sendCommand(ctx, setExCommand(key, client.compress(value), ttl), opts...)
+}
+
+// Expire has the server delete key after ttl, replacing any expiry it had, and
+// reports whether the key existed. The server can only attach an expiry to a
+// write, so the value is read and written back unchanged with one, and a
+// write from another client in between is lost. For the same reason there is
+// no Persist: an expiry, once set, cannot be removed, and it deletes the key
+// when it fires even if the key has been set again since. Nor is there a TTL
+// method: the server keeps expiries to itself, with no command that reports
+// one, so the remaining lifetime of a key cannot be read back. As with SetEx,
+// the server's scheduler must be on.
+func (client *MginDBClient) Expire(key string, ttl time.Duration, opts ...CallOption) (bool, error) {
+    return client.ExpireContext(context.Background(), key, ttl, opts...)
+}
+
+func (client *MginDBClient) ExpireContext(ctx context.Context, key string, ttl time.Duration, opts ...CallOption) (bool, error) {
+    if ttl <= 0 {
+        return false, fmt.Errorf("ttl must be positive, got %s", ttl)
+    }
+    if err := client.validateKey(key); err != nil {
+        return false, err
+    }
+
+    value, err := client.getRaw(ctx, key, opts...)
+    if errors.Is(err, ErrKeyNotFound) {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    reply, err := client.sendCommand(ctx, expireCommand(key, value, ttl), opts...)
+    if err != nil {
+        return false, err
+    }
+    if ok, _ := parseAck(reply); !ok {
+        return false, &ServerError{Command: "SET", Message: reply}
+    }
+    return true, nil
+}
+
+// Get returns the value stored at key. Scalars come back as their plain text
+// (strings unquoted, numbers as written); a key holding nested data returns
+// the server's JSON rendering of it.
+func (client *MginDBClient) Get(key string, opts ...CallOption) (string, error) {
+    return client.GetContext(context.Background(), key, opts...)
+}
+
+func (client *MginDBClient) GetContext(ctx context.Context, key string, opts ...CallOption) (string, error) {
+    if err := client.validateKey(key); err != nil {
+        return "", err
+    }
+    reply, err := client.sendCommand(ctx, getCommand(key), opts...)
+    if err != nil {
+        return "", err
+    }
+    value, err := parseGetReply(key, reply)
+    return decompress(value), err
+}
+
+// compressedPrefix starts a value that CompressValues stored.
+const compressedPrefix = "mgindb+gzip:"
+
+func (client *MginDBClient) compress(value string) string {
+    minSize := client.CompressMinSize
+    if minSize <= 0 {
+        minSize = 1024
+    }
+    if !client.CompressValues || len(value) < minSize {
+        return value
+    }
+
+    var buf bytes.Buffer
+    zw := gzip.NewWriter(&buf)
+    zw.Write([]byte(value))
+    zw.Close()
+    encoded := compressedPrefix + base64.StdEncoding.EncodeToString(buf.Bytes())
+    if len(encoded) >= len(value) {
+        return value
+    }
+    return encoded
+}
+
+// decompress returns value unchanged unless it is a well-formed compressed
+// value, so plain text that happens to start with the prefix survives.
+func decompress(value string) string {
+    encoded, ok := strings.CutPrefix(value, compressedPrefix)
+    if !ok {
+        return value
+    }
+    compressed, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+        return value
+    }
+    zr, err := gzip.NewReader(bytes.NewReader(compressed))
+    if err != nil {
+        return value
+    }
+    plain, err := io.ReadAll(zr)
+    if err != nil {
+        return value
+    }
+    return string(plain)
+}
+
+// parseGetReply unwraps the QUERY result list: [] means the key is absent and
+// [{"value": v}] is a single scalar.
+func parseGetReply(key, reply string) (string, error) {
+    var entries []map[string]json.RawMessage
+    if err := json.Unmarshal([]byte(reply), &entries); err != nil {
+        if !json.Valid([]byte(reply)) {
+            return "", &QueryError{Key: key, Message: reply}
+        }
+        return reply, nil
+    }
+
+    if len(entries) == 0 {
+        return "", ErrKeyNotFound
+    }
+    if len(entries) > 1 || len(entries[0]) != 1 || entries[0]["value"] == nil {
+        return reply, nil
+    }
+
+    value := entries[0]["value"]
+    var text string
+    if err := json.Unmarshal(value, &text); err == nil {
+        return text, nil
+    }
+    return string(value), nil
+}
+
+// GetMulti reads every key in one batch of QUERY commands, the server having
+// no multi-key read, and returns the values as Get would. Absent keys are left
+// out of the map. If the server answers any key with an error, GetMulti
+// returns that error, a *QueryError naming the key, and no map.
+func (client *MginDBClient) GetMulti(keys ...string) (map[string]string, error) {
+    return client.GetMultiContext(context.Background(), keys)
+}
+
+func (client *MginDBClient) GetMultiContext(ctx context.Context, keys []string, opts ...CallOption) (map[string]string, error) {
+    values := make(map[string]string, len(keys))
+    if len(keys) == 0 {
+        return values, nil
+    }
+
+    commands := make([]string, len(keys))
+    for i, key := range keys {
+        if err := client.validateKey(key); err != nil {
+            return nil, err
+        }
+        commands[i] = getCommand(key)
+    }
+
+    replies, err := client.sendCommands(ctx, commands, opts...)
+    if err != nil {
+        return nil, err
+    }
+    for i, key := range keys {
+        value, err := parseGetReply(key, replies[i])
+        if errors.Is(err, ErrKeyNotFound) {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        values[key] = decompress(value)
+    }
+    return values, nil
+}
+
+// SetJSON stores the JSON encoding of v at key. An encoding error is returned
+// before anything is sent.
+func (client *MginDBClient) SetJSON(key string, v interface{}, opts ...CallOption) (string, error) {
+    return client.SetJSONContext(context.Background(), key, v, opts...)
+}
+
+func (client *MginDBClient) SetJSONContext(ctx context.Context, key string, v interface{}, opts ...CallOption) (string, error) {
+    if err := client.validateKey(key); err != nil {
+        return "", err
+    }
+    document, err := client.marshal(v)
+    if err != nil {
+        return "", fmt.Errorf("encode %s: %w", key, err)
+    }
+    return client.sendCommand(ctx, setJSONCommand(key, document), opts...)
+}
+
+// GetJSON decodes the value stored at key, normally by SetJSON, into dest. A
+// missing key returns ErrKeyNotFound; a value that does not decode returns the
+// json error wrapped with the key.
+func (client *MginDBClient) GetJSON(key string, dest interface{}, opts ...CallOption) error {
+    return client.GetJSONContext(context.Background(), key, dest, opts...)
+}
+
+func (client *MginDBClient) GetJSONContext(ctx context.Context, key string, dest interface{}, opts ...CallOption) error {
+    value, err := client.GetContext(ctx, key, opts...)
+    if err != nil {
+        return err
+    }
+    if err := client.unmarshal([]byte(value), dest); err != nil {
+        return fmt.Errorf("decode %s: %w", key, err)
+    }
+    return nil
+}
+
+// SetMulti sets every pair with a single command. Pairs are applied in key
+// order and independently of each other: one failing does not roll back the
+// rest. The reply holds one line per pair, in the same key order, so a partial
+// failure shows up as an "ERROR: ..." line next to the others' "OK". With a
+// single pair the reply is one line, and a failure is a *ServerError.
+func (client *MginDBClient) SetMulti(pairs map[string]string, opts ...CallOption) (string, error) {
+    return client.SetMultiContext(context.Background(), pairs, opts...)
+}
+
+func (client *MginDBClient) SetMultiContext(ctx context.Context, pairs map[string]string, opts ...CallOption) (string, error) {
+    if len(pairs) == 0 {
+        return "", nil
+    }
+    encoded := make(map[string]string, len(pairs))
+    for key, value := range pairs {
+        if err := client.validateKey(key); err != nil {
+            return "", err
+        }
+        encoded[key] = client.compress(value)
+    }
+    return client.sendCommand(ctx, setMultiCommand(encoded), opts...)
+}
+
+// Actions accepted by Indices.
+const (
+    IndexAdd    = "CREATE" // INDICES CREATE <key> <string|set>
+    IndexRemove = "FLUSH"  // INDICES FLUSH <key> drops the whole index
+    IndexList   = "LIST"   // INDICES LIST
+    IndexGet    = "GET"    // INDICES GET <key>
+)
+
+// IndexType is the kind of index CreateIndex builds: a string index maps each
+// value to one entity, a set index to several.
+type IndexType string
+
+const (
+    IndexString IndexType = "string"
+    IndexSet    IndexType = "set"
+)
+
+// Flush deletes every key and every index on the server with FLUSHALL and
+// returns its acknowledgment. It refuses to run, sending nothing, unless
+// FlushConfirm(true) is among opts:
+//
+//	client.Flush(FlushConfirm(true))
+func (client *MginDBClient) Flush(opts ...CallOption) (string, error) {
+    return client.FlushContext(context.Background(), opts...)
+}
+
+func (client *MginDBClient) FlushContext(ctx context.Context, opts ...CallOption) (string, error) {
+    var options callOptions
+    for _, opt := range opts {
+        opt(&options)
+    }
+    if !options.flushConfirmed {
+        return "", ErrFlushNotConfirmed
+    }
+    return client.sendCommand(ctx, "FLUSHALL", opts...)
+}
+
+// Indices is the generic form of CreateIndex, DropIndex and ListIndices, for
+// actions they do not cover such as GET.
+func (client *MginDBClient) Indices(action, key, value string, opts ...CallOption) (string, error) {
+    return client.IndicesContext(context.Background(), action, key, value, opts...)
+}
+
+func (client *MginDBClient) IndicesContext(ctx context.Context, action, key, value string, opts ...CallOption) (string, error) {
+    return client.sendCommand(ctx, indicesCommand(action, key, value), opts...)
+}
+
+func (client *MginDBClient) CreateIndex(key string, indexType IndexType, opts ...CallOption) error {
+    return client.CreateIndexContext(context.Background(), key, indexType, opts...)
+}
+
+func (client *MginDBClient) CreateIndexContext(ctx context.Context, key string, indexType IndexType, opts ...CallOption) error {
+    return client.indexAction(ctx, IndexAdd, key, string(indexType), opts...)
+}
+
+func (client *MginDBClient) DropIndex(key string, opts ...CallOption) error {
+    return client.DropIndexContext(context.Background(), key, opts...)
+}
+
+func (client *MginDBClient) DropIndexContext(ctx context.Context, key string, opts ...CallOption) error {
+    return client.indexAction(ctx, IndexRemove, key, "", opts...)
+}
+
+func (client *MginDBClient) indexAction(ctx context.Context, action, key, value string, opts ...CallOption) error {
+    if err := client.validateKey(key); err != nil {
+        return err
+    }
+    reply, err := client.IndicesContext(ctx, action, key, value, opts...)
+    if err != nil {
+        return err
+    }
+    if ok, _ := parseAck(reply); !ok {
+        return fmt.Errorf("indices %s %s: %s", action, key, reply)
+    }
+    return nil
+}
+
+// ListIndices returns the path of every index, such as "users:email",
+// sorted.
+func (client *MginDBClient) ListIndices(opts ...CallOption) ([]string, error) {
+    return client.ListIndicesContext(context.Background(), opts...)
+}
+
+func (client *MginDBClient) ListIndicesContext(ctx context.Context, opts ...CallOption) ([]string, error) {
+    reply, err := client.IndicesContext(ctx, IndexList, "", "", opts...)
+    if err != nil {
+        return nil, err
+    }
+    return parseIndexList(reply)
+}
+
+// parseIndexList flattens the nested structure INDICES LIST returns, whose
+// leaves are {"type": ..., "keys": [...]}. With no indices the server answers
+// {"message": "No indices defined."}.
+func parseIndexList(reply string) ([]string, error) {
+    var tree map[string]json.RawMessage
+    if err := json.Unmarshal([]byte(reply), &tree); err != nil {
+        return nil, &MalformedReplyError{Command: "INDICES LIST", Reply: reply, Err: err}
+    }
+    if _, ok := tree["message"]; ok && len(tree) == 1 {
+        return nil, nil
+    }
+
+    var paths []string
+    var walk func(prefix string, node map[string]json.RawMessage)
+    walk = func(prefix string, node map[string]json.RawMessage) {
+        for key, raw := range node {
+            var child map[string]json.RawMessage
+            if json.Unmarshal(raw, &child) != nil {
+                continue
+            }
+            if _, leaf := child["type"]; leaf {
+                paths = append(paths, prefix+key)
+                continue
+            }
+            walk(prefix+key+":", child)
+        }
+    }
+    walk("", tree)
+    sort.Strings(paths)
+    return paths, nil
+}
+
+// IndexStats returns the number of distinct values each index holds, keyed
+// by its path as ListIndices gives it. For a string index that is also the
+// number of entities indexed; a set index can have several per value. The
+// server reports no counts itself, so every index is read in full with
+// INDICES GET, all in one batch after an INDICES LIST.
+func (client *MginDBClient) IndexStats(opts ...CallOption) (map[string]int64, error) {
+    return client.IndexStatsContext(context.Background(), opts...)
+}
+
+func (client *MginDBClient) IndexStatsContext(ctx context.Context, opts ...CallOption) (map[string]int64, error) {
+    paths, err := client.ListIndicesContext(ctx, opts...)
+    if err != nil || len(paths) == 0 {
+        return nil, err
+    }
+
+    commands := make([]string, len(paths))
+    for i, path := range paths {
+        commands[i] = indicesCommand(IndexGet, path, "")
+    }
+    replies, err := client.sendCommands(ctx, commands, opts...)
+    if err != nil {
+        return nil, err
+    }
+
+    stats := make(map[string]int64, len(paths))
+    for i, path := range paths {
+        n, err := parseIndexCount(commands[i], replies[i])
+        if err != nil {
+            return nil, err
+        }
+        stats[path] = n
+    }
+    return stats, nil
+}
+
+// parseIndexCount sizes an INDICES GET reply: a list of values for a set
+// index, an object from value to entity for a string index, or {"error": ...}.
+func parseIndexCount(command, reply string) (int64, error) {
+    var values []json.RawMessage
+    if err := json.Unmarshal([]byte(reply), &values); err == nil {
+        return int64(len(values)), nil
+    }
+    var entries map[string]json.RawMessage
+    if err := json.Unmarshal([]byte(reply), &entries); err != nil {
+        return 0, &MalformedReplyError{Command: command, Reply: reply, Err: err}
+    }
+    if message, ok := entries["error"]; ok && len(entries) == 1 {
+        var text string
+        json.Unmarshal(message, &text)
+        return 0, &ServerError{Command: commandName(command), Message: text}
+    }
+    return int64(len(entries)), nil
+}
+
+func (client *MginDBClient) Incr(key, value string, opts ...CallOption) (string, error) {
+    return client.IncrContext(context.Background(), key, value, opts...)
+}
+
+func (client *MginDBClient) IncrContext(ctx context.Context, key, value string, opts ...CallOption) (string, error) {
+    if err := client.validateKey(key); err != nil {
+        return "", err
+    }
+    return client.sendCommand(ctx, incrCommand(key, value), opts...)
+}
+
+func (client *MginDBClient) Decr(key, value string, opts ...CallOption) (string, error) {
+    return client.DecrContext(context.Background(), key, value, opts...)
+}
+
+func (client *MginDBClient) DecrContext(ctx context.Context, key, value string, opts ...CallOption) (string, error) {
+    if err := client.validateKey(key); err != nil {
+        return "", err
+    }
+    return client.sendCommand(ctx, decrCommand(key, value), opts...)
+}
+
+// IncrBy adds delta to the integer at key, starting from zero if the key is
+// absent, and returns the result. The server only answers OK to INCR, so the
+// value is checked before and read back after, in the same batch as the INCR;
+// a concurrent writer on another connection can still land in between.
+func (client *MginDBClient) IncrBy(key string, delta int64, opts ...CallOption) (int64, error) {
+    return client.IncrByContext(context.Background(), key, delta, opts...)
+}
+
+func (client *MginDBClient) IncrByContext(ctx context.Context, key string, delta int64, opts ...CallOption) (int64, error) {
+    return client.addInt(ctx, key, incrCommand(key, strconv.FormatInt(delta, 10)), opts...)
+}
+
+// DecrBy subtracts delta from the integer at key; see IncrBy.
+func (client *MginDBClient) DecrBy(key string, delta int64, opts ...CallOption) (int64, error) {
+    return client.DecrByContext(context.Background(), key, delta, opts...)
+}
+
+func (client *MginDBClient) DecrByContext(ctx context.Context, key string, delta int64, opts ...CallOption) (int64, error) {
+    return client.addInt(ctx, key, decrCommand(key, strconv.FormatInt(delta, 10)), opts...)
+}
+
+// addInt refuses to touch a non-integer value up front: the server fails the
+// arithmetic by dropping the connection rather than with an error reply.
+func (client *MginDBClient) addInt(ctx context.Context, key, command string, opts ...CallOption) (int64, error) {
+    current, err := client.GetContext(ctx, key, opts...)
+    if err != nil && !errors.Is(err, ErrKeyNotFound) {
+        return 0, err
+    }
+    if err == nil {
+        if _, err := strconv.ParseInt(current, 10, 64); err != nil {
+            return 0, &NotNumericError{Key: key, Value: current}
+        }
+    }
+
+    replies, err := client.sendCommands(ctx, []string{command, getCommand(key)}, opts...)
+    if err != nil {
+        return 0, err
+    }
+    if ok, _ := parseAck(replies[0]); !ok {
+        return 0, fmt.Errorf("%s %s: %s", commandName(command), key, replies[0])
+    }
+
+    value, err := parseGetReply(key, replies[1])
+    if err != nil {
+        return 0, err
+    }
+    n, err := strconv.ParseInt(value, 10, 64)
+    if err != nil {
+        return 0, &NotNumericError{Key: key, Value: value}
+    }
+    return n, nil
+}
+
+func (client *MginDBClient) Delete(key string, opts ...CallOption) (string, error) {
+    return client.DeleteContext(context.Background(), key, opts...)
+}
+
+func (client *MginDBClient) DeleteContext(ctx context.Context, key string, opts ...CallOption) (string, error) {
+    if err := client.validateKey(key); err != nil {
+        return "", err
+    }
+    return client.sendCommand(ctx, deleteCommand(key), opts...)
+}
+
+// DeleteOK is Delete reporting whether anything was deleted. A key that does
+// not exist is false with no error.
+func (client *MginDBClient) DeleteOK(key string, opts ...CallOption) (bool, error) {
+    return client.DeleteOKContext(context.Background(), key, opts...)
+}
+
+func (client *MginDBClient) DeleteOKContext(ctx context.Context, key string, opts ...CallOption) (bool, error) {
+    reply, err := client.DeleteContext(ctx, key, opts...)
+    var serverErr *ServerError
+    if errors.As(err, &serverErr) && strings.Contains(serverErr.Message, "does not exist") {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    ok, err := parseAck(reply)
+    if err != nil {
+        return false, &MalformedReplyError{Command: "DEL", Reply: reply, Err: err}
+    }
+    return ok, nil
+}
+
+// DeleteMulti deletes every key with a single command. The reply holds one
+// line per key, in the order given: "OK", "Deleted N entries." for a wildcard
+// key, or an "ERROR: ..." line for a key that could not be deleted. With a
+// single key, a failure is a *ServerError instead.
+func (client *MginDBClient) DeleteMulti(keys ...string) (string, error) {
+    return client.DeleteMultiContext(context.Background(), keys)
+}
+
+func (client *MginDBClient) DeleteMultiContext(ctx context.Context, keys []string, opts ...CallOption) (string, error) {
+    if len(keys) == 0 {
+        return "", nil
+    }
+    for _, key := range keys {
+        if err := client.validateKey(key); err != nil {
+            return "", err
+        }
+    }
+    return client.sendCommand(ctx, deleteMultiCommand(keys), opts...)
+}
+
+// DeleteMultiCount is DeleteMulti reporting how many entries were removed.
+// Keys that were not found, or failed otherwise, are not counted.
+func (client *MginDBClient) DeleteMultiCount(keys ...string) (int, error) {
+    return client.DeleteMultiCountContext(context.Background(), keys)
+}
+
+func (client *MginDBClient) DeleteMultiCountContext(ctx context.Context, keys []string, opts ...CallOption) (int, error) {
+    reply, err := client.DeleteMultiContext(ctx, keys, opts...)
+    var serverErr *ServerError
+    if errors.As(err, &serverErr) {
+        return 0, nil
+    }
+    if err != nil || reply == "" {
+        return 0, err
+    }
+    return countDeleted(reply), nil
+}
+
+func countDeleted(reply string) int {
+    deleted := 0
+    for _, line := range strings.Split(reply, "\n") {
+        var n int
+        switch {
+        case line == "OK":
+            deleted++
+        case strings.HasPrefix(line, "Deleted "):
+            if _, err := fmt.Sscanf(line, "Deleted %d entries.", &n); err == nil {
+                deleted += n
+            }
+        }
+    }
+    return deleted
+}
+
+func (client *MginDBClient) Query(key, queryString, options string, opts ...CallOption) (string, error) {
+    return client.QueryContext(context.Background(), key, queryString, options, opts...)
+}
+
+func (client *MginDBClient) QueryContext(ctx context.Context, key, queryString, options string, opts ...CallOption) (string, error) {
+    return client.sendCommand(ctx, queryCommand(key, queryString, options), opts...)
+}
+
+// QueryInto runs the query and decodes its JSON results into dest.
+func (client *MginDBClient) QueryInto(key, queryString, options string, dest interface{}, opts ...CallOption) error {
+    return client.QueryIntoContext(context.Background(), key, queryString, options, dest, opts...)
+}
+
+func (client *MginDBClient) QueryIntoContext(ctx context.Context, key, queryString, options string, dest interface{}, opts ...CallOption) error {
+    reply, err := client.QueryContext(ctx, key, queryString, options, opts...)
+    if err != nil {
+        return err
+    }
+
+    if !json.Valid([]byte(reply)) {
+        return &QueryError{Key: key, Message: reply}
+    }
+    return client.unmarshal([]byte(reply), dest)
+}
+
+// QueryResult is a query's rows with their metadata.
+type QueryResult struct {
+    Rows      json.RawMessage
+    Count     int
+    ElapsedMs int
+}
+
+// QueryFull runs the query and returns its rows with their count and timing.
+// A server that wraps its results in {"rows": [...], "count": n,
+// "elapsed_ms": n} has the envelope decoded as sent; for the bare JSON array
+// MginDB returns today, Count is the length of the array and ElapsedMs the
+// round trip as measured by the client.
+func (client *MginDBClient) QueryFull(key, queryString, options string, opts ...CallOption) (*QueryResult, error) {
+    return client.QueryFullContext(context.Background(), key, queryString, options, opts...)
+}
+
+func (client *MginDBClient) QueryFullContext(ctx context.Context, key, queryString, options string, opts ...CallOption) (*QueryResult, error) {
+    start := client.clock().Now()
+    reply, err := client.QueryContext(ctx, key, queryString, options, opts...)
+    if err != nil {
+        return nil, err
+    }
+    elapsed := client.clock().Now().Sub(start)
+
+    if !json.Valid([]byte(reply)) {
+        return nil, &QueryError{Key: key, Message: reply}
+    }
+
+    if strings.HasPrefix(reply, "{") {
+        var envelope struct {
+            Rows      json.RawMessage `json:"rows"`
+            Count     *int            `json:"count"`
+            ElapsedMs *int            `json:"elapsed_ms"`
+        }
+        if err := json.Unmarshal([]byte(reply), &envelope); err == nil && envelope.Rows != nil {
+            result := &QueryResult{Rows: envelope.Rows, ElapsedMs: int(elapsed.Milliseconds())}
+            if envelope.ElapsedMs != nil {
+                result.ElapsedMs = *envelope.ElapsedMs
+            }
+            if envelope.Count != nil {
+                result.Count = *envelope.Count
+            } else {
+                result.Count = countRows(envelope.Rows)
+            }
+            return result, nil
+        }
+    }
+
+    return &QueryResult{
+        Rows:      json.RawMessage(reply),
+        Count:     countRows(json.RawMessage(reply)),
+        ElapsedMs: int(elapsed.Milliseconds()),
+    }, nil
+}
+
+// countRows counts the elements of a JSON array; any other value is one row.
+func countRows(rows json.RawMessage) int {
+    var elements []json.RawMessage
+    if err := json.Unmarshal(rows, &elements); err != nil {
+        return 1
+    }
+    return len(elements)
+}
+
+// Keys returns the top-level keys matching pattern, in path.Match syntax, in
+// sorted order; an empty pattern matches every key. The server ignores
+// patterns and has no cursor, so it always sends the whole list in one reply
+// and the filtering happens here. There is no Scan for the same reason.
+func (client *MginDBClient) Keys(pattern string, opts ...CallOption) ([]string, error) {
+    return client.KeysContext(context.Background(), pattern, opts...)
+}
+
+func (client *MginDBClient) KeysContext(ctx context.Context, pattern string, opts ...CallOption) ([]string, error) {
+    if _, err := path.Match(pattern, ""); err != nil {
+        return nil, err
+    }
+    reply, err := client.sendCommand(ctx, keysCommand, opts...)
+    if err != nil {
+        return nil, err
+    }
+
+    var keys []string
+    if err := json.Unmarshal([]byte(reply), &keys); err != nil {
+        return nil, fmt.Errorf("keys: unexpected reply %q: %w", reply, err)
+    }
+    if pattern == "" {
+        return keys, nil
+    }
+    matched := keys[:0]
+    for _, key := range keys {
+        if ok, _ := path.Match(pattern, key); ok {
+            matched = append(matched, key)
+        }
+    }
+    return matched, nil
+}
+
+func (client *MginDBClient) Count(key string, opts ...CallOption) (string, error) {
+    return client.CountContext(context.Background(), key, opts...)
+}
+
+func (client *MginDBClient) CountContext(ctx context.Context, key string, opts ...CallOption) (string, error) {
+    return client.sendCommand(ctx, countCommand(key), opts...)
+}
+
+// Exists reports whether key holds a value. It asks for COUNT rather than the
+// value itself, so large values are not transferred.
+func (client *MginDBClient) Exists(key string, opts ...CallOption) (bool, error) {
+    return client.ExistsContext(context.Background(), key, opts...)
+}
+
+func (client *MginDBClient) ExistsContext(ctx context.Context, key string, opts ...CallOption) (bool, error) {
+    if err := client.validateKey(key); err != nil {
+        return false, err
+    }
+    n, err := client.CountIntContext(ctx, key, opts...)
+    if err != nil {
+        return false, err
+    }
+    return n > 0, nil
+}
+
+func (client *MginDBClient) CountInt(key string, opts ...CallOption) (int64, error) {
+    return client.CountIntContext(context.Background(), key, opts...)
+}
+
+func (client *MginDBClient) CountIntContext(ctx context.Context, key string, opts ...CallOption) (int64, error) {
+    reply, err := client.CountContext(ctx, key, opts...)
+    if err != nil {
+        return 0, err
+    }
+
+    n, err := strconv.ParseInt(strings.TrimSpace(reply), 10, 64)
+    if err != nil {
+        return 0, fmt.Errorf("count %s: unexpected reply %q: %w", key, reply, err)
+    }
+    return n, nil
+}
+
+// Size returns how many bytes the value at key takes as compact JSON, the form
+// the server keeps it in, where Count gives the number of entries. The server
+// has no size command, so the value is read with QUERY and measured here,
+// which costs a transfer of the whole value. An absent key is ErrKeyNotFound.
+func (client *MginDBClient) Size(key string, opts ...CallOption) (int64, error) {
+    return client.SizeContext(context.Background(), key, opts...)
+}
+
+func (client *MginDBClient) SizeContext(ctx context.Context, key string, opts ...CallOption) (int64, error) {
+    if err := client.validateKey(key); err != nil {
+        return 0, err
+    }
+    value, err := client.getRaw(ctx, key, opts...)
+    if err != nil {
+        return 0, err
+    }
+    return int64(len(value)), nil
+}
+
+// getRaw reads the value at key as compact JSON, strings still quoted, where
+// Get would unwrap them.
+func (client *MginDBClient) getRaw(ctx context.Context, key string, opts ...CallOption) (json.RawMessage, error) {
+    reply, err := client.sendCommand(ctx, getCommand(key), opts...)
+    if err != nil {
+        return nil, err
+    }
+
+    value := json.RawMessage(reply)
+    var entries []map[string]json.RawMessage
+    if err := json.Unmarshal(value, &entries); err == nil {
+        if len(entries) == 0 {
+            return nil, ErrKeyNotFound
+        }
+        if len(entries) == 1 && len(entries[0]) == 1 && entries[0]["value"] != nil {
+            value = entries[0]["value"]
+        }
+    }
+
+    var compact bytes.Buffer
+    if err := json.Compact(&compact, value); err != nil {
+        return nil, &QueryError{Key: key, Message: reply}
+    }
+    return compact.Bytes(), nil
+}
+
+func (client *MginDBClient) Schedule(action, cronOrKey, command string, opts ...CallOption) (string, error) {
+    return client.ScheduleContext(context.Background(), action, cronOrKey, command, opts...)
+}
+
+func (client *MginDBClient) ScheduleContext(ctx context.Context, action, cronOrKey, command string, opts ...CallOption) (string, error) {
+    return client.sendCommand(ctx, scheduleCommand(action, cronOrKey, command), opts...)
+}
+
+// ScheduleAdd schedules command to run on the cron expression and returns the
+// job's ID. The server files jobs under the key the command operates on, its
+// second word, so that key is the ID; adding another job for the same key and
+// cron replaces the first.
+func (client *MginDBClient) ScheduleAdd(cron, command string, opts ...CallOption) (jobID string, err error) {
+    return client.ScheduleAddContext(context.Background(), cron, command, opts...)
+}
+
+func (client *MginDBClient) ScheduleAddContext(ctx context.Context, cron, command string, opts ...CallOption) (jobID string, err error) {
+    fields := strings.Fields(command)
+    if len(fields) < 2 {
+        return "", fmt.Errorf("schedule %q: command has no key", command)
+    }
+
+    scheduled := fmt.Sprintf("SCHEDULE ADD %s COMMAND(%s)", cron, command)
+    reply, err := client.sendCommand(ctx, scheduled, opts...)
+    if err != nil {
+        return "", err
+    }
+    if ok, _ := parseAck(reply); !ok {
+        // e.g. the scheduler being off, which is not reported as an ERROR.
+        return "", &ServerError{Command: commandName(scheduled), Message: reply}
+    }
+    return fields[1], nil
+}
+
+// ScheduleRemove deletes the job with the given ID, as returned by
+// ScheduleAdd. An unknown ID returns ErrJobNotFound.
+func (client *MginDBClient) ScheduleRemove(jobKey string, opts ...CallOption) (string, error) {
+    return client.ScheduleRemoveContext(context.Background(), jobKey, opts...)
+}
+
+func (client *MginDBClient) ScheduleRemoveContext(ctx context.Context, jobKey string, opts ...CallOption) (string, error) {
+    reply, err := client.sendCommand(ctx, fmt.Sprintf("SCHEDULE DEL %s", jobKey), opts...)
+    var serverErr *ServerError
+    if errors.As(err, &serverErr) && strings.Contains(serverErr.Message, "not found") {
+        return "", fmt.Errorf("%w: %s", ErrJobNotFound, jobKey)
+    }
+    return reply, err
+}
+
+type ScheduledJob struct {
+    Key     string
+    Cron    string
+    Command string
+    LastRun time.Time // zero if the job has not run yet
+    NextRun time.Time
+}
+
+// ScheduleList returns every scheduled job, ordered by cron expression and
+// then key.
+func (client *MginDBClient) ScheduleList(opts ...CallOption) ([]ScheduledJob, error) {
+    return client.ScheduleListContext(context.Background(), opts...)
+}
+
+func (client *MginDBClient) ScheduleListContext(ctx context.Context, opts ...CallOption) ([]ScheduledJob, error) {
+    reply, err := client.sendCommand(ctx, "SCHEDULE SHOW ALL", opts...)
+    if err != nil {
+        return nil, err
+    }
+    return parseScheduleList(reply)
+}
+
+// parseScheduleList decodes {"<cron>": {"<key>": {"command", "last", "next"}}}
+// with unix timestamps. The server answers None when nothing is scheduled.
+func parseScheduleList(reply string) ([]ScheduledJob, error) {
+    if reply == "None" {
+        return nil, nil
+    }
+
+    var schedules map[string]map[string]struct {
+        Command string  `json:"command"`
+        Last    float64 `json:"last"`
+        Next    float64 `json:"next"`
+    }
+    if err := json.Unmarshal([]byte(reply), &schedules); err != nil {
+        return nil, &MalformedReplyError{Command: "SCHEDULE SHOW ALL", Reply: reply, Err: err}
+    }
+
+    var jobs []ScheduledJob
+    for cron, tasks := range schedules {
+        for key, task := range tasks {
+            jobs = append(jobs, ScheduledJob{
+                Key:     key,
+                Cron:    cron,
+                Command: task.Command,
+                LastRun: unixTime(task.Last),
+                NextRun: unixTime(task.Next),
+            })
+        }
+    }
+    sort.Slice(jobs, func(i, j int) bool {
+        if jobs[i].Cron != jobs[j].Cron {
+            return jobs[i].Cron < jobs[j].Cron
+        }
+        return jobs[i].Key < jobs[j].Key
+    })
+    return jobs, nil
+}
+
+func unixTime(seconds float64) time.Time {
+    if seconds == 0 {
+        return time.Time{}
+    }
+    return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// Exec sends command exactly as given and returns the server's reply, for
+// commands this client has no method for. Nothing is quoted or escaped:
+// values containing spaces, quotes or "|" must be formatted by the caller the
+// way the server expects. Error replies come back as a *ServerError. As with
+// every method, the command is re-sent after a reconnect only if it is one of
+// the idempotent commands, or WithIdempotent(true) is among opts.
+//
+//	reply, err := client.Exec("RENAME old new")
+func (client *MginDBClient) Exec(command string, opts ...CallOption) (string, error) {
+    return client.ExecContext(context.Background(), command, opts...)
+}
+
+func (client *MginDBClient) ExecContext(ctx context.Context, command string, opts ...CallOption) (string, error) {
+    if strings.TrimSpace(command) == "" {
+        return "", errors.New("empty command")
+    }
+    return client.sendCommand(ctx, command, opts...)
+}
+
+// pingCommand is not a server command; any reply to it, normally None, proves
+// the connection is alive and authenticated.
+const pingCommand = "PING"
+
+// Ping makes a round trip to the server. Like any command it replaces a dead
+// connection first, so it doubles as a liveness-and-repair probe.
+func (client *MginDBClient) Ping(opts ...CallOption) error {
+    return client.PingContext(context.Background(), opts...)
+}
+
+func (client *MginDBClient) PingContext(ctx context.Context, opts ...CallOption) error {
+    _, err := client.sendCommand(ctx, pingCommand, opts...)
+    return err
+}
+
+func (client *MginDBClient) Sub(key string, opts ...CallOption) (string, error) {
+    return client.SubContext(context.Background(), key, opts...)
+}
+
+func (client *MginDBClient) SubContext(ctx context.Context, key string, opts ...CallOption) (string, error) {
+    if err := client.validateKey(key); err != nil {
+        return "", err
+    }
+    return client.sendCommand(ctx, subCommand(key), opts...)
+}
+
+func (client *MginDBClient) Unsub(key string, opts ...CallOption) (string, error) {
+    return client.UnsubContext(context.Background(), key, opts...)
+}
+
+func (client *MginDBClient) UnsubContext(ctx context.Context, key string, opts ...CallOption) (string, error) {
+    if err := client.validateKey(key); err != nil {
+        return "", err
+    }
+    client.removeSubscriptions(key)
+    return client.sendCommand(ctx, unsubCommand(key), opts...)
+}
+
+// subscriptionBuffer is how many updates a subscription channel holds before
+// Backpressure applies.
+const subscriptionBuffer = 64
+
+// A BackpressurePolicy is what the reader does with an update for a full
+// subscription channel; see MginDBClient.Backpressure.
+type BackpressurePolicy int
+
+const (
+    DropOldest BackpressurePolicy = iota // discard the oldest queued update
+    DropNewest                           // discard the incoming update
+    Block                                // wait for the consumer
+)
+
+// A subscription either feeds a channel or, when handler is set, calls it.
+type subscription struct {
+    ch      chan []byte
+    handler func(key string, data []byte)
+    onClose func()
+    quit    chan struct{}
+    once    sync.Once
+    mutex   sync.Mutex
+    closed  bool
+}
+
+// Subscribe sends SUB for key and returns a channel carrying the JSON data of
+// every update the server pushes for it. The channel is closed by Unsub, by
+// Close, or when the connection is lost for good, in which case Err reports
+// why. While MaxRetries allows it, a lost connection is redialed in the
+// background and its subscriptions are sent again, so the channel stays open
+// across reconnects; updates pushed while disconnected are missed, as are
+// those dropped under Backpressure while the channel is full.
+func (client *MginDBClient) Subscribe(key string, opts ...CallOption) (<-chan []byte, error) {
+    return client.SubscribeContext(context.Background(), key, opts...)
+}
+
+func (client *MginDBClient) SubscribeContext(ctx context.Context, key string, opts ...CallOption) (<-chan []byte, error) {
+    sub := &subscription{ch: make(chan []byte, subscriptionBuffer), quit: make(chan struct{})}
+    if err := client.addSubscription(ctx, key, sub, opts...); err != nil {
+        return nil, err
+    }
+    return sub.ch, nil
+}
+
+// SubscribeJSON is Subscribe with each update decoded into a T. An update
+// that fails to decode is reported on the error channel, which never blocks
+// delivery: when nobody drains it, further errors are dropped. Decoded values
+// are subject to Backpressure just as Subscribe's updates are, and both
+// channels are closed when the subscription ends.
+func SubscribeJSON[T any](client *MginDBClient, key string, opts ...CallOption) (<-chan T, <-chan error, error) {
+    return SubscribeJSONContext[T](context.Background(), client, key, opts...)
+}
+
+func SubscribeJSONContext[T any](ctx context.Context, client *MginDBClient, key string, opts ...CallOption) (<-chan T, <-chan error, error) {
+    sub := &subscription{ch: make(chan []byte, subscriptionBuffer), quit: make(chan struct{})}
+    if err := client.addSubscription(ctx, key, sub, opts...); err != nil {
+        return nil, nil, err
+    }
+
+    // A send blocked under Block gives up once the subscription ends.
+    values := make(chan T, subscriptionBuffer)
+    errs := make(chan error, 1)
+    go func() {
+        defer close(values)
+        defer close(errs)
+        for msg := range sub.ch {
+            var value T
+            if err := client.unmarshal(msg, &value); err != nil {
+                select {
+                case errs <- fmt.Errorf("decode update for %s: %w", key, err):
+                default:
+                }
+                continue
+            }
+            offer(values, value, sub.quit, client.Backpressure, &client.stats.dropped)
+        }
+    }()
+    return values, errs, nil
+}
+
+// KeyedMessage is an update delivered by SubscribeMulti or SubscribePattern,
+// with the key it was pushed for.
+type KeyedMessage struct {
+    Key  string
+    Data []byte
+}
+
+// SubscribeMulti subscribes to every key with a single SUB and returns one
+// channel carrying all of their updates. Each key behaves as with Subscribe,
+// and the channel is closed once none of them is subscribed any more, whether
+// through UnsubscribeMulti, Unsub, Close or a connection lost for good.
+func (client *MginDBClient) SubscribeMulti(keys ...string) (<-chan KeyedMessage, error) {
+    return client.SubscribeMultiContext(context.Background(), keys)
+}
+
+func (client *MginDBClient) SubscribeMultiContext(ctx context.Context, keys []string, opts ...CallOption) (<-chan KeyedMessage, error) {
+    keys, err := client.multiKeys(keys)
+    if err != nil {
+        return nil, err
+    }
+
+    m := &multiplexer{out: make(chan KeyedMessage, subscriptionBuffer)}
+    m.open.Store(int32(len(keys)))
+    subs := make([]*subscription, len(keys))
+    for i, key := range keys {
+        sub := &subscription{quit: make(chan struct{}), onClose: m.release}
+        sub.handler = func(key string, data []byte) {
+            m.send(KeyedMessage{Key: key, Data: data}, sub.quit, client.Backpressure, &client.stats.dropped)
+        }
+        subs[i] = sub
+        client.registerSubscription(key, sub)
+    }
+
+    if _, err := client.sendCommand(ctx, subCommand(strings.Join(keys, ",")), opts...); err != nil {
+        for i, key := range keys {
+            client.removeSubscription(key, subs[i])
+        }
+        return nil, err
+    }
+    return m.out, nil
+}
+
+// SubscribePattern subscribes to every key under a prefix, written the
+// server's way as "prefix:*", and returns one channel with their updates,
+// each tagged with the key that changed. The server matches "user:*" against
+// user:1 and user:1:name alike. In every other respect a pattern behaves as a
+// key given to SubscribeMulti: it is sent again after a reconnect, and
+// UnsubscribePattern, Unsub or Close ends it.
+func (client *MginDBClient) SubscribePattern(pattern string, opts ...CallOption) (<-chan KeyedMessage, error) {
+    return client.SubscribePatternContext(context.Background(), pattern, opts...)
+}
+
+func (client *MginDBClient) SubscribePatternContext(ctx context.Context, pattern string, opts ...CallOption) (<-chan KeyedMessage, error) {
+    if err := validatePattern(pattern); err != nil {
+        return nil, err
+    }
+    return client.SubscribeMultiContext(ctx, []string{pattern}, opts...)
+}
+
+// UnsubscribePattern ends every subscription to pattern and sends UNSUB for it.
+func (client *MginDBClient) UnsubscribePattern(pattern string, opts ...CallOption) (string, error) {
+    return client.UnsubscribePatternContext(context.Background(), pattern, opts...)
+}
+
+func (client *MginDBClient) UnsubscribePatternContext(ctx context.Context, pattern string, opts ...CallOption) (string, error) {
+    if err := validatePattern(pattern); err != nil {
+        return "", err
+    }
+    return client.UnsubscribeMultiContext(ctx, []string{pattern}, opts...)
+}
+
+func validatePattern(pattern string) error {
+    if prefix, ok := strings.CutSuffix(pattern, ":*"); !ok || prefix == "" {
+        return fmt.Errorf("%w %q: a pattern is a prefix followed by :*", ErrInvalidKey, pattern)
+    }
+    return nil
+}
+
+// pushTargets lists the subscriptions a push for key goes to, picked the way
+// the server picks its subscribers: key itself, "p:*" for every prefix p of
+// key including key, and "p:*:*" for every shorter one.
+func pushTargets(key string) []string {
+    parts := strings.Split(key, ":")
+    targets := []string{key}
+    for i := 1; i <= len(parts); i++ {
+        prefix := strings.Join(parts[:i], ":")
+        targets = append(targets, prefix+":*")
+        if i < len(parts) {
+            targets = append(targets, prefix+":*:*")
+        }
+    }
+    return targets
+}
+
+// UnsubscribeMulti removes every subscription to the keys, however made, and
+// sends a single UNSUB for them.
+func (client *MginDBClient) UnsubscribeMulti(keys ...string) (string, error) {
+    return client.UnsubscribeMultiContext(context.Background(), keys)
+}
+
+func (client *MginDBClient) UnsubscribeMultiContext(ctx context.Context, keys []string, opts ...CallOption) (string, error) {
+    keys, err := client.multiKeys(keys)
+    if err != nil {
+        return "", err
+    }
+    for _, key := range keys {
+        client.removeSubscriptions(key)
+    }
+    return client.sendCommand(ctx, unsubCommand(strings.Join(keys, ",")), opts...)
+}
+
+// multiKeys validates and deduplicates keys for a comma-separated SUB or
+// UNSUB, in which a key cannot itself contain a comma.
+func (client *MginDBClient) multiKeys(keys []string) ([]string, error) {
+    if len(keys) == 0 {
+        return nil, fmt.Errorf("%w: no keys", ErrInvalidKey)
+    }
+    seen := make(map[string]bool, len(keys))
+    unique := make([]string, 0, len(keys))
+    for _, key := range keys {
+        if err := client.validateKey(key); err != nil {
+            return nil, err
+        }
+        if strings.Contains(key, ",") {
+            return nil, fmt.Errorf("%w %q: contains ,", ErrInvalidKey, key)
+        }
+        if !seen[key] {
+            seen[key] = true
+            unique = append(unique, key)
+        }
+    }
+    return unique, nil
+}
+
+// multiplexer merges the updates of several subscriptions into one channel,
+// closed when the last of them closes.
+type multiplexer struct {
+    out    chan KeyedMessage
+    open   atomic.Int32
+    mutex  sync.Mutex
+    closed bool
+}
+
+// send gives up when the subscription it delivers for is closed, so every
+// send has returned by the time the last one is.
+func (m *multiplexer) send(msg KeyedMessage, quit <-chan struct{}, policy BackpressurePolicy, dropped *atomic.Int64) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    if m.closed {
+        return
+    }
+    offer(m.out, msg, quit, policy, dropped)
+}
+
+func (m *multiplexer) release() {
+    if m.open.Add(-1) != 0 {
+        return
+    }
+    m.mutex.Lock()
+    m.closed = true
+    close(m.out)
+    m.mutex.Unlock()
+}
+
+// OnMessage sends SUB for key and calls handler with the JSON data of every
+// update pushed for it; several handlers may share a key. Handlers run on the
+// reader goroutine, so they must return quickly and must not issue commands
+// on the same client, whose replies that goroutine would never get to read.
+// A panicking handler is recovered and reported to OnHandlerPanic. The
+// returned func removes the handler, sending UNSUB once no subscriber is left
+// for key.
+func (client *MginDBClient) OnMessage(key string, handler func(msg []byte), opts ...CallOption) (func() error, error) {
+    return client.OnMessageContext(context.Background(), key, handler, opts...)
+}
+
+func (client *MginDBClient) OnMessageContext(ctx context.Context, key string, handler func(msg []byte), opts ...CallOption) (func() error, error) {
+    sub := &subscription{quit: make(chan struct{})}
+    sub.handler = func(_ string, data []byte) {
+        handler(data)
+    }
+    if err := client.addSubscription(ctx, key, sub, opts...); err != nil {
+        return nil, err
+    }
+
+    remove := func() error {
+        if !client.removeSubscription(key, sub) {
+            return nil
+        }
+        _, err := client.sendCommand(context.Background(), unsubCommand(key), opts...)
+        return err
+    }
+    return remove, nil
+}
+
+// SubscribeAndServe subscribes to key and calls handler with every update on
+// the calling goroutine until ctx ends, returning ctx.Err(), or handler
+// returns an error, which is returned unless ContinueOnError(true) is given.
+// If the subscription ends first it returns Err, which is nil after Close or
+// Unsub. Unlike OnMessage handlers, handler may issue commands on the client.
+func (client *MginDBClient) SubscribeAndServe(ctx context.Context, key string, handler func(msg []byte) error, opts ...CallOption) error {
+    options := callOptions{}
+    for _, opt := range opts {
+        opt(&options)
+    }
+
+    sub := &subscription{ch: make(chan []byte, subscriptionBuffer), quit: make(chan struct{})}
+    if err := client.addSubscription(ctx, key, sub, opts...); err != nil {
+        return err
+    }
+    defer func() {
+        if client.removeSubscription(key, sub) {
+            client.sendCommand(context.Background(), unsubCommand(key), opts...)
+        }
+    }()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case msg, ok := <-sub.ch:
+            if !ok {
+                return client.Err()
+            }
+            if err := handler(msg); err != nil && !options.keepServing {
+                return err
+            }
+        }
+    }
+}
+
+// addSubscription registers sub before sending SUB, so an update racing the
+// reply is not lost.
+func (client *MginDBClient) addSubscription(ctx context.Context, key string, sub *subscription, opts ...CallOption) error {
+    if err := client.validateKey(key); err != nil {
+        return err
+    }
+
+    client.registerSubscription(key, sub)
+    if _, err := client.SubContext(ctx, key, opts...); err != nil {
+        client.removeSubscription(key, sub)
+        return err
+    }
+    return nil
+}
+
+func (client *MginDBClient) registerSubscription(key string, sub *subscription) {
+    client.subMutex.Lock()
+    defer client.subMutex.Unlock()
+
+    if client.subscriptions == nil {
+        client.subscriptions = make(map[string][]*subscription)
+    }
+    client.subscriptions[key] = append(client.subscriptions[key], sub)
+}
+
+// SubscribeWithSnapshot is Subscribe that also returns the value key holds as
+// the subscription starts, or "" if it holds none. SUB and the read are
+// written back to back, so the server handles them with nothing from this
+// connection in between, and the subscription is active before the read: no
+// update is missed, but one from another client landing between the two may
+// be reflected in initial and also arrive on the channel.
+func (client *MginDBClient) SubscribeWithSnapshot(key string, opts ...CallOption) (initial string, updates <-chan []byte, err error) {
+    return client.SubscribeWithSnapshotContext(context.Background(), key, opts...)
+}
+
+func (client *MginDBClient) SubscribeWithSnapshotContext(ctx context.Context, key string, opts ...CallOption) (initial string, updates <-chan []byte, err error) {
+    if err := client.validateKey(key); err != nil {
+        return "", nil, err
+    }
+
+    sub := &subscription{ch: make(chan []byte, subscriptionBuffer), quit: make(chan struct{})}
+    client.registerSubscription(key, sub)
+
+    replies, err := client.sendCommands(ctx, []string{subCommand(key), getCommand(key)}, opts...)
+    if err == nil {
+        if serverErr := parseServerError(subCommand(key), replies[0]); serverErr != nil {
+            err = serverErr
+        }
+    }
+    if err != nil {
+        client.removeSubscription(key, sub)
+        return "", nil, err
+    }
+
+    initial, err = parseGetReply(key, replies[1])
+    initial = decompress(initial)
+    if errors.Is(err, ErrKeyNotFound) {
+        return "", sub.ch, nil
+    }
+    if err != nil {
+        if client.removeSubscription(key, sub) {
+            client.sendCommand(context.Background(), unsubCommand(key), opts...)
+        }
+        return "", nil, err
+    }
+    return initial, sub.ch, nil
+}
+
+// Err returns the error that ended the last connection's reader and closed
+// any subscription channels, or nil if it was closed deliberately.
+func (client *MginDBClient) Err() error {
+    client.subMutex.Lock()
+    defer client.subMutex.Unlock()
+
+    return client.subErr
+}
+
+func (client *MginDBClient) deliver(push pushMessage) {
+    client.subMutex.Lock()
+    var subs []*subscription
+    for _, target := range pushTargets(push.Key) {
+        subs = append(subs, client.subscriptions[target]...)
+    }
+    client.subMutex.Unlock()
+
+    for _, sub := range subs {
+        if sub.handler != nil {
+            client.dispatch(push.Key, sub, push.Data)
+        } else {
+            sub.send(push.Data, client.Backpressure, &client.stats.dropped)
+        }
+    }
 }
 
-type AuthData struct {
-    Username string `json:"username"`
-    Password string `json:"password"`
+func (client *MginDBClient) dispatch(key string, sub *subscription, data []byte) {
+    defer func() {
+        if recovered := recover(); recovered != nil && client.OnHandlerPanic != nil {
+            client.OnHandlerPanic(key, fmt.Errorf("handler panic: %v", recovered))
+        }
+    }()
+
+    sub.mutex.Lock()
+    closed := sub.closed
+    sub.mutex.Unlock()
+    if !closed {
+        sub.handler(key, data)
+    }
 }
 
-func NewMginDBClient(protocol, host string, port int, username, password string) *MginDBClient {
-    uri := fmt.Sprintf("%s://%s:%d", protocol, host, port)
-    return &MginDBClient{uri: uri, username: username, password: password}
+func (sub *subscription) send(data []byte, policy BackpressurePolicy, dropped *atomic.Int64) {
+    sub.mutex.Lock()
+    defer sub.mutex.Unlock()
+
+    if sub.closed {
+        return
+    }
+    offer(sub.ch, data, sub.quit, policy, dropped)
 }
 
-func (client *MginDBClient) Connect() error {
-    u, err := url.Parse(client.uri)
-    if err != nil {
-        return err
+// offer puts v on ch as policy says to when ch is full. Callers hold the lock
+// that serializes sends on ch, so under DropOldest no other send can take the
+// slot it frees.
+func offer[T any](ch chan T, v T, quit <-chan struct{}, policy BackpressurePolicy, dropped *atomic.Int64) {
+    if policy == Block {
+        select {
+        case ch <- v:
+        case <-quit:
+        }
+        return
+    }
+
+    for {
+        select {
+        case ch <- v:
+            return
+        default:
+        }
+        if policy == DropNewest {
+            dropped.Add(1)
+            return
+        }
+        select {
+        case <-ch:
+            dropped.Add(1)
+        default:
+        }
+    }
+}
+
+// close first releases a reader blocked in send, then closes the channel once
+// no send can be in flight.
+func (sub *subscription) close() {
+    sub.once.Do(func() {
+        close(sub.quit)
+
+        sub.mutex.Lock()
+        sub.closed = true
+        if sub.ch != nil {
+            close(sub.ch)
+        }
+        sub.mutex.Unlock()
+
+        if sub.onClose != nil {
+            sub.onClose()
+        }
+    })
+}
+
+func (client *MginDBClient) removeSubscriptions(key string) {
+    client.subMutex.Lock()
+    subs := client.subscriptions[key]
+    delete(client.subscriptions, key)
+    client.subMutex.Unlock()
+
+    for _, sub := range subs {
+        sub.close()
+    }
+}
+
+// removeSubscription reports whether target was the last subscriber for key.
+func (client *MginDBClient) removeSubscription(key string, target *subscription) bool {
+    client.subMutex.Lock()
+    subs := client.subscriptions[key]
+    found := false
+    for i, sub := range subs {
+        if sub == target {
+            client.subscriptions[key] = append(subs[:i:i], subs[i+1:]...)
+            found = true
+            break
+        }
+    }
+    last := found && len(client.subscriptions[key]) == 0
+    if last {
+        delete(client.subscriptions, key)
     }
+    client.subMutex.Unlock()
+
+    target.close()
+    return last
+}
+
+// closeSubscriptions must be called with subMutex held.
+func (client *MginDBClient) closeSubscriptions() {
+    for key, subs := range client.subscriptions {
+        for _, sub := range subs {
+            sub.close()
+        }
+        delete(client.subscriptions, key)
+    }
+}
+
+// Close closes the connection and every subscription channel, then waits for
+// the connection's background goroutines (reader, keepalive and any
+// background redial) to exit. It is safe to call more than once and from
+// several goroutines. It must not be called from an OnMessage handler, which
+// runs on the reader it waits for.
+func (client *MginDBClient) Close() error {
+    client.subMutex.Lock()
+    if client.stopRestore != nil {
+        client.stopRestore()
+    }
+    client.subMutex.Unlock()
 
     client.mutex.Lock()
-    defer client.mutex.Unlock()
+    client.closed = true
+    if client.connection != nil {
+        client.closeHandshake()
+    }
+    r := client.reader
+    err := client.dropConnection()
+    client.setState(Closed)
 
-    c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-    if err != nil {
-        return err
+    client.subMutex.Lock()
+    client.resubscribe = false
+    client.closeSubscriptions()
+    client.subMutex.Unlock()
+    client.mutex.Unlock()
+
+    // A redial attempt already under way needs the mutex to notice the
+    // client is closed, so the wait happens after releasing it.
+    if r != nil {
+        r.workers.Wait()
     }
-    client.connection = c
+    client.restores.Wait()
+    return err
+}
 
-    authData := AuthData{Username: client.username, Password: client.password}
-    authDataJson, err := ujson.Marshal(authData)
-    if err != nil {
-        return err
+// SetAsync is Set without waiting for the reply: cb, if not nil, is called
+// with it on its own goroutine once it arrives. The command is written before
+// SetAsync returns, so async commands reach the server in call order, and it
+// blocks only while the client connects or the socket is busy. Failures,
+// including an invalid key, are reported to cb. Async commands are never
+// retried.
+func (client *MginDBClient) SetAsync(key, value string, cb func(reply string, err error), opts ...CallOption) {
+    client.SetAsyncContext(context.Background(), key, value, cb, opts...)
+}
+
+func (client *MginDBClient) SetAsyncContext(ctx context.Context, key, value string, cb func(reply string, err error), opts ...CallOption) {
+    client.sendAsync(ctx, key, setCommand(key, client.compress(value)), cb, opts...)
+}
+
+func (client *MginDBClient) IncrAsync(key, value string, cb func(reply string, err error), opts ...CallOption) {
+    client.IncrAsyncContext(context.Background(), key, value, cb, opts...)
+}
+
+func (client *MginDBClient) IncrAsyncContext(ctx context.Context, key, value string, cb func(reply string, err error), opts ...CallOption) {
+    client.sendAsync(ctx, key, incrCommand(key, value), cb, opts...)
+}
+
+func (client *MginDBClient) DecrAsync(key, value string, cb func(reply string, err error), opts ...CallOption) {
+    client.DecrAsyncContext(context.Background(), key, value, cb, opts...)
+}
+
+func (client *MginDBClient) DecrAsyncContext(ctx context.Context, key, value string, cb func(reply string, err error), opts ...CallOption) {
+    client.sendAsync(ctx, key, decrCommand(key, value), cb, opts...)
+}
+
+func (client *MginDBClient) DeleteAsync(key string, cb func(reply string, err error), opts ...CallOption) {
+    client.DeleteAsyncContext(context.Background(), key, cb, opts...)
+}
+
+func (client *MginDBClient) DeleteAsyncContext(ctx context.Context, key string, cb func(reply string, err error), opts ...CallOption) {
+    client.sendAsync(ctx, key, deleteCommand(key), cb, opts...)
+}
+
+// sendAsync writes command on the caller's goroutine and waits for its reply
+// on another, where cb and OnCommand are called.
+func (client *MginDBClient) sendAsync(ctx context.Context, key, command string, cb func(reply string, err error), opts ...CallOption) {
+    start := client.clock().Now()
+    options := callOptions{timeout: client.commandTimeout()}
+    for _, opt := range opts {
+        opt(&options)
     }
 
-    err = client.connection.WriteMessage(websocket.TextMessage, authDataJson)
-    if err != nil {
-        return err
+    var r *reader
+    var waiters []chan []byte
+    err := client.validateKey(key)
+    if err == nil {
+        err = ctx.Err()
+    }
+    acquired := false
+    if err == nil {
+        err = client.acquireInFlight(ctx)
+        acquired = err == nil
+    }
+    if err == nil {
+        r, waiters, _, err = client.submit(ctx, []string{command}, options)
+    }
+
+    go func() {
+        if acquired {
+            defer client.releaseInFlight()
+        }
+        var reply string
+        if err == nil {
+            var replies []string
+            if replies, _, err = client.await(ctx, r, waiters, []string{command}, options); err == nil {
+                reply = replies[0]
+                if serverErr := parseServerError(command, reply); serverErr != nil {
+                    reply, err = "", serverErr
+                }
+            }
+        }
+        if err != nil {
+            client.stats.errors.Add(1)
+        }
+        client.reportCommand(ctx, command, client.clock().Now().Sub(start), err)
+        if cb != nil {
+            cb(reply, err)
+        }
+    }()
+}
+
+// Pipeline buffers commands and sends them in one batch, so n commands cost a
+// single round trip instead of n.
+//
+// A batch is not a transaction. The server has no transaction commands, so
+// each command is applied as it arrives, other clients' commands can land in
+// between, and a failure midway leaves the earlier commands applied. Its
+// ROLLBACK command restores a backup; it does not undo a batch.
+type Pipeline struct {
+    client   *MginDBClient
+    commands []string
+    err      error
+}
+
+func (client *MginDBClient) Pipeline() *Pipeline {
+    return &Pipeline{client: client}
+}
+
+func (p *Pipeline) Set(key, value string) *Pipeline {
+    return p.addKeyed(key, setCommand(key, p.client.compress(value)))
+}
+
+func (p *Pipeline) Indices(action, key, value string) *Pipeline {
+    return p.add(indicesCommand(action, key, value))
+}
+
+func (p *Pipeline) Incr(key, value string) *Pipeline {
+    return p.addKeyed(key, incrCommand(key, value))
+}
+
+func (p *Pipeline) Decr(key, value string) *Pipeline {
+    return p.addKeyed(key, decrCommand(key, value))
+}
+
+func (p *Pipeline) Delete(key string) *Pipeline {
+    return p.addKeyed(key, deleteCommand(key))
+}
+
+func (p *Pipeline) Query(key, queryString, options string) *Pipeline {
+    return p.add(queryCommand(key, queryString, options))
+}
+
+func (p *Pipeline) Count(key string) *Pipeline {
+    return p.add(countCommand(key))
+}
+
+func (p *Pipeline) Schedule(action, cronOrKey, command string) *Pipeline {
+    return p.add(scheduleCommand(action, cronOrKey, command))
+}
+
+func (p *Pipeline) add(command string) *Pipeline {
+    p.commands = append(p.commands, command)
+    return p
+}
+
+// addKeyed remembers the first invalid key so that Exec can fail without
+// sending anything.
+func (p *Pipeline) addKeyed(key, command string) *Pipeline {
+    if err := p.client.validateKey(key); err != nil && p.err == nil {
+        p.err = err
     }
+    return p.add(command)
+}
+
+// Len returns the number of buffered commands.
+func (p *Pipeline) Len() int {
+    return len(p.commands)
+}
+
+// Commands returns the buffered commands exactly as Exec would send them,
+// without sending anything. The Pipeline methods compose commands the same
+// way as their client counterparts, so this is also a dry run for checking
+// what Set or Query put on the wire:
+//
+//	client.Pipeline().Set("user:1", `say "hi"`).Commands()
+func (p *Pipeline) Commands() []string {
+    return append([]string(nil), p.commands...)
+}
+
+// Exec writes every buffered command, then reads the replies, which are
+// returned in the order the commands were added. The commands are written
+// contiguously, so other callers' traffic cannot interleave with the batch.
+// The buffer is emptied either way, and a batch is never retried after a
+// connection failure because some of its commands may already have been
+// applied.
+func (p *Pipeline) Exec(opts ...CallOption) ([]string, error) {
+    return p.ExecContext(context.Background(), opts...)
+}
 
-    _, message, err := client.connection.ReadMessage()
+func (p *Pipeline) ExecContext(ctx context.Context, opts ...CallOption) ([]string, error) {
+    commands, err := p.commands, p.err
+    p.commands, p.err = nil, nil
     if err != nil {
-        return err
+        return nil, err
+    }
+    if len(commands) == 0 {
+        return nil, nil
+    }
+    return p.client.sendCommands(ctx, commands, opts...)
+}
+
+var (
+    ErrPoolExhausted = errors.New("pool exhausted")
+    ErrPoolClosed    = errors.New("pool closed")
+)
+
+// Pool spreads commands over several connections. Each call borrows an idle
+// client for the duration of one command and then returns it.
+type Pool struct {
+    // Wait makes a call block until a client is free when all of them are in
+    // use; otherwise the call fails with ErrPoolExhausted. WaitTimeout, when
+    // non-zero, bounds that wait. NewPool enables Wait with no timeout.
+    Wait        bool
+    WaitTimeout time.Duration
+
+    clients []*MginDBClient
+    idle    chan *MginDBClient
+    done    chan struct{}
+    once    sync.Once
+    mutex   sync.Mutex
+    inUse   map[*MginDBClient]bool // checked out and not yet put back
+    warmUp  int                    // -1 meaning all; see WithPoolWarmUp
+}
+
+// PoolOption configures a Pool as NewPoolWithOptions creates it.
+type PoolOption func(*Pool)
+
+// WithPoolWarmUp makes NewPoolWithOptions connect min of the clients, or all
+// of them when min is zero or less, before it returns, as Pool.WarmUp would;
+// the pool is then not created if any of them cannot connect.
+func WithPoolWarmUp(min int) PoolOption {
+    return func(p *Pool) {
+        if min <= 0 {
+            min = -1
+        }
+        p.warmUp = min
+    }
+}
+
+// NewPool creates size clients that share opts. They connect lazily, on their
+// first command.
+func NewPool(size int, protocol, host string, port int, opts ...Option) (*Pool, error) {
+    return NewPoolWithOptions(size, protocol, host, port, nil, opts...)
+}
+
+// NewPoolWithOptions is NewPool with poolOpts applied to the pool itself.
+func NewPoolWithOptions(size int, protocol, host string, port int, poolOpts []PoolOption, opts ...Option) (*Pool, error) {
+    if size <= 0 {
+        return nil, fmt.Errorf("pool size must be positive, got %d", size)
+    }
+
+    p := &Pool{
+        Wait:  true,
+        idle:  make(chan *MginDBClient, size),
+        done:  make(chan struct{}),
+        inUse: make(map[*MginDBClient]bool),
+    }
+    for _, opt := range poolOpts {
+        opt(p)
+    }
+    for i := 0; i < size; i++ {
+        client := NewMginDBClient(protocol, host, port, opts...)
+        p.clients = append(p.clients, client)
+        p.idle <- client
+    }
+    if p.warmUp != 0 {
+        if err := p.WarmUp(context.Background(), p.warmUp); err != nil {
+            p.Close()
+            return nil, err
+        }
+    }
+    return p, nil
+}
+
+func (p *Pool) get(ctx context.Context) (*MginDBClient, error) {
+    select {
+    case <-p.done:
+        return nil, ErrPoolClosed
+    default:
+    }
+
+    select {
+    case client := <-p.idle:
+        return p.checkout(client), nil
+    default:
+    }
+    if !p.Wait {
+        return nil, ErrPoolExhausted
+    }
+
+    var expired <-chan time.Time
+    if p.WaitTimeout > 0 {
+        timer := p.clients[0].clock().NewTimer(p.WaitTimeout)
+        defer timer.Stop()
+        expired = timer.C()
     }
 
-    if string(message) != "MginDB server connected... Welcome!" {
-        return fmt.Errorf("failed to authenticate: %s", message)
+    select {
+    case <-p.done:
+        return nil, ErrPoolClosed
+    case client := <-p.idle:
+        return p.checkout(client), nil
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    case <-expired:
+        return nil, ErrPoolExhausted
     }
+}
+
+// Acquire takes an idle client for the caller's exclusive use until Release,
+// waiting as configured by Wait and WaitTimeout but no longer than ctx
+// allows, in which case it returns ctx.Err().
+func (p *Pool) Acquire(ctx context.Context) (*MginDBClient, error) {
+    return p.get(ctx)
+}
+
+// Release returns a client taken with Acquire to the pool. Releasing it again,
+// or releasing a client the pool did not hand out, does nothing.
+func (p *Pool) Release(client *MginDBClient) {
+    p.put(client)
+}
 
+// WarmUp connects the first min clients, or all of them when min is zero or
+// more than the pool holds, instead of leaving it to their first command.
+// Call it right after NewPool, or use WithPoolWarmUp, to find an
+// unreachable server or bad credentials at startup; the pool stays usable,
+// and lazy, if WarmUp fails.
+func (p *Pool) WarmUp(ctx context.Context, min int) error {
+    if min <= 0 || min > len(p.clients) {
+        min = len(p.clients)
+    }
+    for i, client := range p.clients[:min] {
+        if err := client.connect(ctx); err != nil {
+            return fmt.Errorf("warm up connection %d of %d: %w", i+1, min, err)
+        }
+    }
     return nil
 }
 
-func (client *MginDBClient) sendCommand(command string) (string, error) {
-    client.mutex.Lock()
-    defer client.mutex.Unlock()
+// HealthCheck pings every idle client, which also replaces a dead connection,
+// and returns the errors joined. Clients in use at the time are skipped.
+func (p *Pool) HealthCheck() error {
+    var idle []*MginDBClient
+    for len(idle) < len(p.clients) {
+        select {
+        case client := <-p.idle:
+            idle = append(idle, p.checkout(client))
+            continue
+        default:
+        }
+        break
+    }
 
-    if client.connection == nil {
-        if err := client.Connect(); err != nil {
-            return "", err
+    var errs []error
+    for _, client := range idle {
+        if err := client.Ping(); err != nil {
+            errs = append(errs, err)
         }
+        p.put(client)
+    }
+    return errors.Join(errs...)
+}
+
+func (p *Pool) checkout(client *MginDBClient) *MginDBClient {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    p.inUse[client] = true
+    return client
+}
+
+// put only takes back a client that is checked out, so one released twice is
+// never handed to two callers at once, and idle, which has room for every
+// client, never blocks.
+func (p *Pool) put(client *MginDBClient) {
+    p.mutex.Lock()
+    if !p.inUse[client] {
+        p.mutex.Unlock()
+        return
     }
+    delete(p.inUse, client)
+    p.mutex.Unlock()
 
-    err := client.connection.WriteMessage(websocket.TextMessage, []byte(command))
+    p.idle <- client
+}
+
+// Do runs fn with a client acquired as by Acquire with ctx, and releases the
+// client when fn returns, even if it panics; the panic then carries on up
+// the caller's stack. Pass ctx on to the Context methods inside fn to bound
+// the commands as well as the wait.
+//
+//	err := pool.Do(ctx, func(client *MginDBClient) error {
+//	    _, err := client.SetContext(ctx, "greeting", "hello")
+//	    return err
+//	})
+func (p *Pool) Do(ctx context.Context, fn func(client *MginDBClient) error) error {
+    client, err := p.get(ctx)
     if err != nil {
-        return "", err
+        return err
     }
+    defer p.put(client)
 
-    _, message, err := client.connection.ReadMessage()
+    return fn(client)
+}
+
+func (p *Pool) do(ctx context.Context, fn func(client *MginDBClient) (string, error)) (string, error) {
+    client, err := p.get(ctx)
     if err != nil {
         return "", err
     }
+    defer p.put(client)
 
-    return string(message), nil
+    return fn(client)
 }
 
-func (client *MginDBClient) Set(key, value string) (string, error) {
-    return client.sendCommand(fmt.Sprintf("SET %s %s", key, value))
+func (p *Pool) Set(key, value string, opts ...CallOption) (string, error) {
+    return p.do(context.Background(), func(client *MginDBClient) (string, error) {
+        return client.Set(key, value, opts...)
+    })
 }
 
-func (client *MginDBClient) Indices(action, key, value string) (string, error) {
-    return client.sendCommand(fmt.Sprintf("INDICES %s %s %s", action, key, value))
+func (p *Pool) Get(key string, opts ...CallOption) (string, error) {
+    return p.do(context.Background(), func(client *MginDBClient) (string, error) {
+        return client.Get(key, opts...)
+    })
 }
 
-func (client *MginDBClient) Incr(key, value string) (string, error) {
-    return client.sendCommand(fmt.Sprintf("INCR %s %s", key, value))
+func (p *Pool) Indices(action, key, value string, opts ...CallOption) (string, error) {
+    return p.do(context.Background(), func(client *MginDBClient) (string, error) {
+        return client.Indices(action, key, value, opts...)
+    })
 }
 
-func (client *MginDBClient) Decr(key, value string) (string, error) {
-    return client.sendCommand(fmt.Sprintf("DECR %s %s", key, value))
+func (p *Pool) Incr(key, value string, opts ...CallOption) (string, error) {
+    return p.do(context.Background(), func(client *MginDBClient) (string, error) {
+        return client.Incr(key, value, opts...)
+    })
 }
 
-func (client *MginDBClient) Delete(key string) (string, error) {
-    return client.sendCommand(fmt.Sprintf("DEL %s", key))
+func (p *Pool) Decr(key, value string, opts ...CallOption) (string, error) {
+    return p.do(context.Background(), func(client *MginDBClient) (string, error) {
+        return client.Decr(key, value, opts...)
+    })
 }
 
-func (client *MginDBClient) Query(key, queryString, options string) (string, error) {
-    return client.sendCommand(fmt.Sprintf("QUERY %s %s %s", key, queryString, options))
+func (p *Pool) Delete(key string, opts ...CallOption) (string, error) {
+    return p.do(context.Background(), func(client *MginDBClient) (string, error) {
+        return client.Delete(key, opts...)
+    })
 }
 
-func (client *MginDBClient) Count(key string) (string, error) {
-    return client.sendCommand(fmt.Sprintf("COUNT %s", key))
+func (p *Pool) Query(key, queryString, options string, opts ...CallOption) (string, error) {
+    return p.do(context.Background(), func(client *MginDBClient) (string, error) {
+        return client.Query(key, queryString, options, opts...)
+    })
 }
 
-func (client *MginDBClient) Schedule(action, cronOrKey, command string) (string, error) {
-    return client.sendCommand(fmt.Sprintf("SCHEDULE %s %s %s", action, cronOrKey, command))
+func (p *Pool) Count(key string, opts ...CallOption) (string, error) {
+    return p.do(context.Background(), func(client *MginDBClient) (string, error) {
+        return client.Count(key, opts...)
+    })
 }
 
-func (client *MginDBClient) Sub(key string) (string, error) {
-    return client.sendCommand(fmt.Sprintf("SUB %s", key))
+func (p *Pool) Schedule(action, cronOrKey, command string, opts ...CallOption) (string, error) {
+    return p.do(context.Background(), func(client *MginDBClient) (string, error) {
+        return client.Schedule(action, cronOrKey, command, opts...)
+    })
 }
 
-func (client *MginDBClient) Unsub(key string) (string, error) {
-    return client.sendCommand(fmt.Sprintf("UNSUB %s", key))
+// Close closes every client. Calls waiting for a client fail with
+// ErrPoolClosed, and commands still in flight fail with ErrNotConnected.
+func (p *Pool) Close() error {
+    var err error
+    p.once.Do(func() {
+        close(p.done)
+        for _, client := range p.clients {
+            if closeErr := client.Close(); closeErr != nil && err == nil {
+                err = closeErr
+            }
+        }
+    })
+    return err
 }
 
-func (client *MginDBClient) Close() error {
-    client.mutex.Lock()
-    defer client.mutex.Unlock()
+// Endpoint is the address of one server, as passed to NewMginDBClient.
+type Endpoint struct {
+    Protocol string
+    Host     string
+    Port     int
+}
 
-    if client.connection != nil {
-        err := client.connection.Close()
-        client.connection = nil
-        return err
+// Cluster sends writes to a primary server and spreads Get, Query and Count
+// over its replicas in turn. A read that cannot reach a replica moves on to
+// the next one, and to the primary when none can be reached; an answer from
+// a server, errors included, is final. Replicas apply writes after the
+// primary does, so a read straight after a write may not see it.
+type Cluster struct {
+    primary  *MginDBClient
+    replicas []*MginDBClient
+    next     atomic.Uint64
+}
+
+// NewMginDBClientCluster creates one client per endpoint, all sharing opts.
+// With no replicas every command goes to the primary.
+func NewMginDBClientCluster(primary Endpoint, replicas []Endpoint, opts ...Option) *Cluster {
+    c := &Cluster{primary: NewMginDBClient(primary.Protocol, primary.Host, primary.Port, opts...)}
+    for _, replica := range replicas {
+        c.replicas = append(c.replicas, NewMginDBClient(replica.Protocol, replica.Host, replica.Port, opts...))
     }
-    return nil
+    return c
+}
+
+// Primary returns the client for the primary, for commands Cluster does not
+// route.
+func (c *Cluster) Primary() *MginDBClient {
+    return c.primary
+}
+
+func (c *Cluster) read(fn func(client *MginDBClient) (string, error)) (string, error) {
+    if len(c.replicas) > 0 {
+        start := c.next.Add(1)
+        for i := range c.replicas {
+            replica := c.replicas[(start+uint64(i))%uint64(len(c.replicas))]
+            reply, err := fn(replica)
+            if err == nil || answered(err) {
+                return reply, err
+            }
+        }
+    }
+    return fn(c.primary)
+}
+
+// answered reports whether err came from a server's reply rather than from
+// failing to get one.
+func answered(err error) bool {
+    var serverErr *ServerError
+    var queryErr *QueryError
+    var malformedErr *MalformedReplyError
+    return errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrInvalidKey) ||
+        errors.As(err, &serverErr) || errors.As(err, &queryErr) || errors.As(err, &malformedErr)
+}
+
+func (c *Cluster) Get(key string, opts ...CallOption) (string, error) {
+    return c.read(func(client *MginDBClient) (string, error) {
+        return client.Get(key, opts...)
+    })
+}
+
+func (c *Cluster) Query(key, queryString, options string, opts ...CallOption) (string, error) {
+    return c.read(func(client *MginDBClient) (string, error) {
+        return client.Query(key, queryString, options, opts...)
+    })
+}
+
+func (c *Cluster) Count(key string, opts ...CallOption) (string, error) {
+    return c.read(func(client *MginDBClient) (string, error) {
+        return client.Count(key, opts...)
+    })
+}
+
+func (c *Cluster) Set(key, value string, opts ...CallOption) (string, error) {
+    return c.primary.Set(key, value, opts...)
+}
+
+func (c *Cluster) Incr(key, value string, opts ...CallOption) (string, error) {
+    return c.primary.Incr(key, value, opts...)
+}
+
+func (c *Cluster) Decr(key, value string, opts ...CallOption) (string, error) {
+    return c.primary.Decr(key, value, opts...)
+}
+
+func (c *Cluster) Delete(key string, opts ...CallOption) (string, error) {
+    return c.primary.Delete(key, opts...)
+}
+
+// Close closes every client and returns the first error.
+func (c *Cluster) Close() error {
+    err := c.primary.Close()
+    for _, replica := range c.replicas {
+        if closeErr := replica.Close(); closeErr != nil && err == nil {
+            err = closeErr
+        }
+    }
+    return err
+}
+
+// QueryBuilder composes the queryString and options arguments of Query:
+//
+//	NewQuery("users").Where("age", ">", 30).Where("city", "=", "Paris").
+//	    OrderByDesc("age").Limit(10).Run(client)
+//
+// Conditions added with Where are joined with AND, those added with OrWhere
+// with OR, and the server evaluates them left to right.
+type QueryBuilder struct {
+    key        string
+    conditions []string
+    orderBy    string
+    desc       bool
+    groupBy    string
+    include    []string
+    limit      int
+    offset     int
+}
+
+func NewQuery(key string) *QueryBuilder {
+    return &QueryBuilder{key: key}
+}
+
+func (q *QueryBuilder) Where(field, op string, value interface{}) *QueryBuilder {
+    return q.condition("AND", field, op, value)
+}
+
+func (q *QueryBuilder) OrWhere(field, op string, value interface{}) *QueryBuilder {
+    return q.condition("OR", field, op, value)
+}
+
+// condition quotes string values, which the server strips again, so values
+// containing spaces or operators stay in one piece.
+func (q *QueryBuilder) condition(join, field, op string, value interface{}) *QueryBuilder {
+    literal := fmt.Sprint(value)
+    if s, ok := value.(string); ok {
+        literal = strconv.Quote(s)
+    }
+    if len(q.conditions) > 0 {
+        q.conditions = append(q.conditions, join)
+    }
+    q.conditions = append(q.conditions, field+op+literal)
+    return q
+}
+
+func (q *QueryBuilder) OrderBy(field string) *QueryBuilder {
+    q.orderBy, q.desc = field, false
+    return q
+}
+
+func (q *QueryBuilder) OrderByDesc(field string) *QueryBuilder {
+    q.orderBy, q.desc = field, true
+    return q
+}
+
+func (q *QueryBuilder) GroupBy(field string) *QueryBuilder {
+    q.groupBy = field
+    return q
+}
+
+// Include has the server return only the named fields of each result.
+func (q *QueryBuilder) Include(fields ...string) *QueryBuilder {
+    q.include = fields
+    return q
+}
+
+// Limit caps the number of results; zero means no limit.
+func (q *QueryBuilder) Limit(n int) *QueryBuilder {
+    q.limit = n
+    return q
+}
+
+// Offset skips the first n results. The server only accepts an offset as part
+// of LIMIT, so it has no effect without Limit.
+func (q *QueryBuilder) Offset(n int) *QueryBuilder {
+    q.offset = n
+    return q
+}
+
+// Build returns the arguments to pass to Query along with the builder's key.
+func (q *QueryBuilder) Build() (queryString, options string) {
+    if len(q.conditions) > 0 {
+        queryString = "WHERE " + strings.Join(q.conditions, " ")
+    }
+
+    var modifiers []string
+    if q.orderBy != "" {
+        direction := "ASC"
+        if q.desc {
+            direction = "DESC"
+        }
+        modifiers = append(modifiers, fmt.Sprintf("ORDERBY(%s,%s)", q.orderBy, direction))
+    }
+    if q.groupBy != "" {
+        modifiers = append(modifiers, fmt.Sprintf("GROUPBY(%s)", q.groupBy))
+    }
+    if len(q.include) > 0 {
+        modifiers = append(modifiers, fmt.Sprintf("INCLUDE(%s)", strings.Join(q.include, ",")))
+    }
+    if q.limit > 0 {
+        modifiers = append(modifiers, fmt.Sprintf("LIMIT(%d,%d)", q.offset, q.limit))
+    }
+    return queryString, strings.Join(modifiers, " ")
+}
+
+func (q *QueryBuilder) Run(client *MginDBClient, opts ...CallOption) (string, error) {
+    return q.RunContext(context.Background(), client, opts...)
+}
+
+func (q *QueryBuilder) RunContext(ctx context.Context, client *MginDBClient, opts ...CallOption) (string, error) {
+    queryString, options := q.Build()
+    return client.QueryContext(ctx, q.key, queryString, options, opts...)
+}
+
+// QueryOptions are the common modifiers of a query, checked and rendered by
+// QueryWithOptions. Sort is a field name, prefixed with "-" for descending
+// order. Fields, when set, limits each result to the named fields.
+type QueryOptions struct {
+    Limit  int
+    Offset int
+    Sort   string
+    Fields []string
+}
+
+func (o QueryOptions) options() (string, error) {
+    switch {
+    case o.Limit < 0 || o.Offset < 0:
+        return "", fmt.Errorf("query options: negative limit or offset")
+    case o.Offset > 0 && o.Limit == 0:
+        // The server only takes an offset as part of LIMIT.
+        return "", fmt.Errorf("query options: offset %d without a limit", o.Offset)
+    case o.Sort == "-":
+        return "", fmt.Errorf("query options: sort has no field")
+    }
+    for _, field := range o.Fields {
+        if field == "" {
+            return "", fmt.Errorf("query options: empty field name")
+        }
+        if strings.ContainsAny(field, ",)") {
+            // Either would end the server's INCLUDE list early.
+            return "", fmt.Errorf("query options: field %q contains \",\" or \")\"", field)
+        }
+    }
+
+    q := &QueryBuilder{limit: o.Limit, offset: o.Offset, include: o.Fields}
+    if field, desc := strings.CutPrefix(o.Sort, "-"); desc {
+        q.OrderByDesc(field)
+    } else if field != "" {
+        q.OrderBy(field)
+    }
+    _, options := q.Build()
+    return options, nil
+}
+
+// QueryWithOptions is Query with its options built from opts. Invalid
+// combinations are rejected before anything is sent.
+func (client *MginDBClient) QueryWithOptions(key, queryString string, opts QueryOptions, callOpts ...CallOption) (string, error) {
+    return client.QueryWithOptionsContext(context.Background(), key, queryString, opts, callOpts...)
+}
+
+func (client *MginDBClient) QueryWithOptionsContext(ctx context.Context, key, queryString string, opts QueryOptions, callOpts ...CallOption) (string, error) {
+    options, err := opts.options()
+    if err != nil {
+        return "", err
+    }
+    return client.QueryContext(ctx, key, queryString, options, callOpts...)
 }
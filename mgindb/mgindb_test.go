@@ -0,0 +1,771 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "runtime"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+
+    "github.com/justgodev/MginDB/mgindb/mgindbtest"
+)
+
+// rawServer accepts one login per connection and hands every later message
+// to handle, which writes whatever replies it likes, so tests can play the
+// server's quirks that mgindbtest smooths over.
+func rawServer(t *testing.T, handle func(conn *websocket.Conn, command string)) (host string, port int) {
+    t.Helper()
+    var upgrader websocket.Upgrader
+    return listen(t, func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        if _, _, err := conn.ReadMessage(); err != nil {
+            return
+        }
+        conn.WriteMessage(websocket.TextMessage, []byte("MginDB server connected... Welcome!"))
+        for {
+            _, message, err := conn.ReadMessage()
+            if err != nil {
+                return
+            }
+            handle(conn, string(message))
+        }
+    })
+}
+
+// listen serves handler on a loopback port until the test ends.
+func listen(t *testing.T, handler http.HandlerFunc) (host string, port int) {
+    t.Helper()
+    srv := httptest.NewServer(handler)
+    t.Cleanup(srv.Close)
+    host, portText, _ := net.SplitHostPort(srv.Listener.Addr().String())
+    port, _ = strconv.Atoi(portText)
+    return host, port
+}
+
+func newTestServer(t *testing.T) (*mgindbtest.Server, *MginDBClient) {
+    t.Helper()
+    srv := mgindbtest.NewServer()
+    t.Cleanup(srv.Close)
+    client := NewMginDBClient("ws", srv.Host(), srv.Port())
+    t.Cleanup(func() { client.Close() })
+    return srv, client
+}
+
+func rows(from, to int) []map[string]int {
+    list := make([]map[string]int, 0, to-from)
+    for i := from; i < to; i++ {
+        list = append(list, map[string]int{"value": i})
+    }
+    return list
+}
+
+func TestBatchedQueryKeepsRepliesInOrder(t *testing.T) {
+    const total = 2500
+    host, port := rawServer(t, func(conn *websocket.Conn, command string) {
+        send := func(v any) {
+            message, _ := json.Marshal(v)
+            conn.WriteMessage(websocket.TextMessage, message)
+        }
+        switch command {
+        case "QUERY big", "QUERY sharded":
+            for i := 0; i < total; i += 1000 {
+                end := i + 1000
+                if end > total {
+                    end = total
+                }
+                send(rows(i, end))
+            }
+            if command == "QUERY big" {
+                send(rows(0, total))
+            } else {
+                conn.WriteMessage(websocket.TextMessage, []byte(batchedResults))
+            }
+        case "QUERY small":
+            send(rows(0, 1))
+        default:
+            conn.WriteMessage(websocket.TextMessage, []byte("None"))
+        }
+    })
+    client := NewMginDBClient("ws", host, port)
+    defer client.Close()
+
+    for _, key := range []string{"big", "sharded", "small"} {
+        reply, err := client.Exec("QUERY " + key)
+        if err != nil {
+            t.Fatalf("QUERY %s: %v", key, err)
+        }
+        var got []map[string]int
+        if err := json.Unmarshal([]byte(reply), &got); err != nil {
+            t.Fatalf("QUERY %s: %v", key, err)
+        }
+        want := total
+        if key == "small" {
+            want = 1
+        }
+        if len(got) != want || got[len(got)-1]["value"] != want-1 {
+            t.Fatalf("QUERY %s returned %d rows, want %d", key, len(got), want)
+        }
+    }
+    if reply, err := client.Exec("INFO"); err != nil || reply != "None" {
+        t.Fatalf("INFO after batched queries = %q, %v", reply, err)
+    }
+}
+
+func TestSetRoundTripsValuesTheServerWouldRewrite(t *testing.T) {
+    _, client := newTestServer(t)
+    values := []string{
+        "two words",
+        " padded ",
+        `say "hi"`,
+        `"quoted"`,
+        "line\nbreak",
+        "a|b",
+        "call(me)",
+        "upper(x)",
+        "nested(upper(x))",
+        "x -f y",
+        `{"a":"b"}`,
+    }
+    for _, value := range values {
+        if _, err := client.Set("k", value); err != nil {
+            t.Fatalf("Set(%q): %v", value, err)
+        }
+        got, err := client.Get("k")
+        if err != nil {
+            t.Fatalf("Get after Set(%q): %v", value, err)
+        }
+        if got != value {
+            t.Errorf("Set(%q) read back as %q", value, got)
+        }
+    }
+}
+
+func TestSetTimeoutWhileCommandsRun(t *testing.T) {
+    _, client := newTestServer(t)
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 20; j++ {
+                if _, err := client.Set("k", "v"); err != nil {
+                    t.Error(err)
+                    return
+                }
+            }
+        }()
+    }
+    for j := 0; j < 20; j++ {
+        client.SetTimeout(time.Duration(j+1) * time.Second)
+    }
+    wg.Wait()
+}
+
+func TestDroppedConnectionIsNotADisconnect(t *testing.T) {
+    host, port := rawServer(t, func(conn *websocket.Conn, command string) {
+        if command == "CLOSE" {
+            conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "bye"))
+            return
+        }
+        conn.UnderlyingConn().Close()
+    })
+    client := NewMginDBClient("ws", host, port)
+    defer client.Close()
+
+    var disconnect *DisconnectError
+    _, err := client.Exec("DROP")
+    if err == nil || errors.As(err, &disconnect) {
+        t.Fatalf("dropped connection returned %v, want a plain connection error", err)
+    }
+    _, err = client.Exec("CLOSE")
+    if !errors.As(err, &disconnect) || disconnect.Code != websocket.CloseGoingAway {
+        t.Fatalf("close frame returned %v, want a DisconnectError with code 1001", err)
+    }
+}
+
+func TestLoginPayload(t *testing.T) {
+    logins := make(chan string, 1)
+    var upgrader websocket.Upgrader
+    host, port := listen(t, func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        _, message, err := conn.ReadMessage()
+        if err != nil {
+            return
+        }
+        logins <- string(message)
+        conn.WriteMessage(websocket.TextMessage, []byte("MginDB server connected... Welcome!"))
+        conn.ReadMessage()
+    })
+
+    client := NewMginDBClient("ws", host, port, WithCredentials("u", "p"))
+    defer client.Close()
+    if err := client.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    if got, want := <-logins, `{"username":"u","password":"p"}`; got != want {
+        t.Fatalf("login = %s, want %s", got, want)
+    }
+}
+
+func TestConcurrentFirstCommands(t *testing.T) {
+    srv, client := newTestServer(t)
+    srv.Seed("k", `"v"`)
+
+    const goroutines = 16
+    var wg sync.WaitGroup
+    start := make(chan struct{})
+    for i := 0; i < goroutines; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            <-start
+            if got, err := client.Get("k"); err != nil || got != "v" {
+                t.Errorf("Get = %q, %v", got, err)
+            }
+        }()
+    }
+    close(start)
+    wg.Wait()
+    if stats := client.Stats(); stats.Reconnects != 0 {
+        t.Fatalf("cold client connected %d extra times", stats.Reconnects)
+    }
+}
+
+func TestPushAfterCommandTimeout(t *testing.T) {
+    srv := mgindbtest.NewServer()
+    defer srv.Close()
+    client := NewMginDBClient("ws", srv.Host(), srv.Port(), WithCommandTimeout(50*time.Millisecond))
+    defer client.Close()
+
+    updates, err := client.Subscribe("k")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := client.Set("other", "1"); err != nil {
+        t.Fatal(err)
+    }
+    // Outlast the timeout of both commands: a read deadline left behind by
+    // either would now fail the read of the push.
+    time.Sleep(150 * time.Millisecond)
+    srv.Publish("k", `"hello"`)
+    select {
+    case data := <-updates:
+        if string(data) != `"hello"` {
+            t.Fatalf("push = %s", data)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("no push after the timeout window")
+    }
+    if _, err := client.Set("other", "2"); err != nil {
+        t.Fatalf("command after the push: %v", err)
+    }
+}
+
+func TestCloseStopsEveryGoroutine(t *testing.T) {
+    // The server drops the connection after each SUB, so the client is
+    // always restoring its subscription when Close comes.
+    host, port := rawServer(t, func(conn *websocket.Conn, command string) {
+        conn.WriteMessage(websocket.TextMessage, []byte("OK"))
+        conn.UnderlyingConn().Close()
+    })
+    before := runtime.NumGoroutine()
+    for i := 0; i < 5; i++ {
+        client := NewMginDBClient("ws", host, port,
+            WithKeepAlive(time.Second),
+            WithRetry(100, 5*time.Millisecond))
+        if _, err := client.Subscribe("k"); err != nil {
+            t.Fatal(err)
+        }
+        time.Sleep(20 * time.Millisecond)
+        client.Close()
+    }
+
+    deadline := time.Now().Add(2 * time.Second)
+    for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if after := runtime.NumGoroutine(); after > before {
+        buf := make([]byte, 1<<16)
+        t.Fatalf("%d goroutines before, %d after Close:\n%s", before, after, buf[:runtime.Stack(buf, true)])
+    }
+}
+
+func TestLoginWithoutWelcomeTimesOut(t *testing.T) {
+    closed := make(chan struct{})
+    var upgrader websocket.Upgrader
+    host, port := listen(t, func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        conn.ReadMessage()
+        // Never answer the login; the read only ends once the client
+        // gives up and closes its side.
+        conn.ReadMessage()
+        close(closed)
+    })
+
+    client := NewMginDBClient("ws", host, port, WithHandshakeTimeout(100*time.Millisecond))
+    defer client.Close()
+    var authErr *AuthTimeoutError
+    if err := client.Connect(); !errors.As(err, &authErr) {
+        t.Fatalf("Connect = %v, want an AuthTimeoutError", err)
+    }
+    select {
+    case <-closed:
+    case <-time.After(time.Second):
+        t.Fatal("the connection was left open after the login timed out")
+    }
+}
+
+func TestSubscribeJSONEndsWithUnreadValues(t *testing.T) {
+    srv := mgindbtest.NewServer()
+    defer srv.Close()
+    before := runtime.NumGoroutine()
+    client := NewMginDBClient("ws", srv.Host(), srv.Port(), WithBackpressure(Block))
+
+    values, errs, err := SubscribeJSON[int](client, "k")
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Nobody reads values, so the decoding goroutine ends up blocked on a
+    // full channel, and Close must still release it.
+    for i := 0; i < 3*subscriptionBuffer; i++ {
+        srv.Publish("k", strconv.Itoa(i))
+    }
+    time.Sleep(50 * time.Millisecond)
+    client.Close()
+
+    deadline := time.Now().Add(3 * time.Second)
+    for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if after := runtime.NumGoroutine(); after > before {
+        t.Fatalf("%d goroutines before, %d after Close", before, after)
+    }
+    for range values {
+    }
+    if err, open := <-errs; open {
+        t.Fatalf("unexpected decode error %v", err)
+    }
+}
+
+// fakeClock only moves when Advance is called, so tests can step through
+// timeouts, keepalive intervals and backoff without waiting for them.
+type fakeClock struct {
+    mutex   sync.Mutex
+    now     time.Time
+    timers  []*fakeTimer // running
+    started []time.Duration
+}
+
+type fakeTimer struct {
+    clock *fakeClock
+    at    time.Time
+    c     chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+    return c.NewTimer(d).C()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    t := &fakeTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+    c.timers = append(c.timers, t)
+    c.started = append(c.started, d)
+    return t
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+    return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+    c := t.clock
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    for i, pending := range c.timers {
+        if pending == t {
+            c.timers = append(c.timers[:i], c.timers[i+1:]...)
+            return true
+        }
+    }
+    return false
+}
+
+// Advance moves the clock on by d and fires every timer that falls due.
+func (c *fakeClock) Advance(d time.Duration) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    c.now = c.now.Add(d)
+    pending := c.timers[:0]
+    for _, t := range c.timers {
+        if t.at.After(c.now) {
+            pending = append(pending, t)
+            continue
+        }
+        t.c <- c.now
+    }
+    c.timers = pending
+}
+
+// waitStarted blocks until the nth timer since the clock was created has
+// been started and returns its duration.
+func (c *fakeClock) waitStarted(t *testing.T, n int) time.Duration {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        c.mutex.Lock()
+        started := c.started
+        c.mutex.Unlock()
+        if len(started) >= n {
+            return started[n-1]
+        }
+        time.Sleep(time.Millisecond)
+    }
+    t.Fatalf("timer %d was never started", n)
+    return 0
+}
+
+func TestCommandTimeoutOnFakeClock(t *testing.T) {
+    host, port := rawServer(t, func(conn *websocket.Conn, command string) {})
+    clock := &fakeClock{now: time.Unix(0, 0)}
+    client := NewMginDBClient("ws", host, port, withClock(clock), WithCommandTimeout(time.Hour))
+    defer client.Close()
+    if err := client.Connect(); err != nil {
+        t.Fatal(err)
+    }
+
+    done := make(chan error, 1)
+    go func() {
+        _, err := client.Exec("INFO")
+        done <- err
+    }()
+    if d := clock.waitStarted(t, 1); d != time.Hour {
+        t.Fatalf("command timer = %v, want 1h", d)
+    }
+    clock.Advance(time.Hour)
+    var timeoutErr *TimeoutError
+    if err := <-done; !errors.As(err, &timeoutErr) || timeoutErr.After != time.Hour {
+        t.Fatalf("Exec = %v, want a TimeoutError after 1h", err)
+    }
+}
+
+func TestKeepAliveOnFakeClock(t *testing.T) {
+    var ignorePings bool
+    var mutex sync.Mutex
+    var upgrader websocket.Upgrader
+    host, port := listen(t, func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        mutex.Lock()
+        if ignorePings {
+            conn.SetPingHandler(func(string) error { return nil })
+        }
+        mutex.Unlock()
+        conn.ReadMessage()
+        conn.WriteMessage(websocket.TextMessage, []byte("MginDB server connected... Welcome!"))
+        for {
+            if _, _, err := conn.ReadMessage(); err != nil {
+                return
+            }
+        }
+    })
+
+    for _, ignore := range []bool{false, true} {
+        mutex.Lock()
+        ignorePings = ignore
+        mutex.Unlock()
+        clock := &fakeClock{now: time.Unix(0, 0)}
+        client := NewMginDBClient("ws", host, port, withClock(clock), WithKeepAlive(time.Minute))
+        if err := client.Connect(); err != nil {
+            t.Fatal(err)
+        }
+
+        // The first timer is the wait for the next ping, the second the
+        // wait for its pong, and a third appears only once a pong arrived.
+        if d := clock.waitStarted(t, 1); d != time.Minute {
+            t.Fatalf("keepalive interval = %v, want 1m", d)
+        }
+        clock.Advance(time.Minute)
+        if d := clock.waitStarted(t, 2); d != time.Minute {
+            t.Fatalf("pong wait = %v, want 1m", d)
+        }
+        if !ignore {
+            clock.waitStarted(t, 3)
+            if err := client.LastError(); err != nil {
+                t.Fatalf("answered keepalive failed: %v", err)
+            }
+            client.Close()
+            continue
+        }
+        clock.Advance(time.Minute)
+        deadline := time.Now().Add(5 * time.Second)
+        for client.LastError() == nil && time.Now().Before(deadline) {
+            time.Sleep(time.Millisecond)
+        }
+        if err := client.LastError(); !errors.Is(err, errPongTimeout) {
+            t.Fatalf("unanswered keepalive = %v, want %v", err, errPongTimeout)
+        }
+        client.Close()
+    }
+}
+
+func TestWaitForConnectionBackoffOnFakeClock(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    port := listener.Addr().(*net.TCPAddr).Port
+    listener.Close()
+
+    clock := &fakeClock{now: time.Unix(0, 0)}
+    client := NewMginDBClient("ws", "127.0.0.1", port, withClock(clock), WithRetry(0, 100*time.Millisecond))
+    defer client.Close()
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error, 1)
+    go func() { done <- client.WaitForConnection(ctx) }()
+
+    want := []time.Duration{100, 200, 400, 800, 1600, 3200, 5000, 5000}
+    for i, ms := range want {
+        if d := clock.waitStarted(t, i+1); d != ms*time.Millisecond {
+            t.Fatalf("backoff = %v, want %v", d, ms*time.Millisecond)
+        }
+        clock.Advance(ms * time.Millisecond)
+    }
+    cancel()
+    if err := <-done; !errors.Is(err, context.Canceled) {
+        t.Fatalf("WaitForConnection = %v, want context.Canceled", err)
+    }
+}
+
+func TestPoolIgnoresDoubleRelease(t *testing.T) {
+    srv := mgindbtest.NewServer()
+    defer srv.Close()
+    pool, err := NewPool(2, "ws", srv.Host(), srv.Port())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer pool.Close()
+    pool.Wait = false
+
+    ctx := context.Background()
+    client, err := pool.Acquire(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pool.Release(client)
+    pool.Release(client)
+    pool.Release(NewMginDBClient("ws", srv.Host(), srv.Port()))
+
+    first, err := pool.Acquire(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    second, err := pool.Acquire(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if first == second {
+        t.Fatal("a client released twice was handed out twice")
+    }
+    if _, err := pool.Acquire(ctx); !errors.Is(err, ErrPoolExhausted) {
+        t.Fatalf("third Acquire = %v, want ErrPoolExhausted", err)
+    }
+}
+
+func TestNewPoolWarmUp(t *testing.T) {
+    srv := mgindbtest.NewServer()
+    defer srv.Close()
+    pool, err := NewPoolWithOptions(3, "ws", srv.Host(), srv.Port(), []PoolOption{WithPoolWarmUp(2)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer pool.Close()
+    for i, client := range pool.clients {
+        if want := i < 2; client.IsConnected() != want {
+            t.Errorf("client %d connected = %v, want %v", i, !want, want)
+        }
+    }
+
+    srv.Credentials("u", "p")
+    if _, err := NewPoolWithOptions(2, "ws", srv.Host(), srv.Port(), []PoolOption{WithPoolWarmUp(0)}, WithCredentials("u", "wrong")); err == nil {
+        t.Fatal("NewPool warmed up with bad credentials")
+    }
+}
+
+func TestQueryWithOptionsIncludesFields(t *testing.T) {
+    srv, client := newTestServer(t)
+    opts := QueryOptions{Limit: 5, Offset: 2, Sort: "-age", Fields: []string{"name", "city"}}
+    if _, err := client.QueryWithOptions("users", "WHERE age>1", opts); err != nil {
+        t.Fatal(err)
+    }
+    want := "QUERY users WHERE age>1 ORDERBY(age,DESC) INCLUDE(name,city) LIMIT(2,5)"
+    if got := srv.Received(); len(got) == 0 || got[0] != want {
+        t.Fatalf("sent %q, want %q", got, want)
+    }
+    for _, field := range []string{"a,b", "a)"} {
+        if _, err := client.QueryWithOptions("users", "", QueryOptions{Fields: []string{field}}); err == nil {
+            t.Errorf("field %q was accepted", field)
+        }
+    }
+}
+
+func TestRestoreBackoffDoesNotBlockTheClient(t *testing.T) {
+    // The first connection drops after the SUB and the server then refuses
+    // every new one, so the background redial sits in its backoff.
+    var connections atomic.Int32
+    var upgrader websocket.Upgrader
+    host, port := listen(t, func(w http.ResponseWriter, r *http.Request) {
+        if connections.Add(1) > 1 {
+            http.Error(w, "down", http.StatusServiceUnavailable)
+            return
+        }
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        conn.ReadMessage()
+        conn.WriteMessage(websocket.TextMessage, []byte("MginDB server connected... Welcome!"))
+        conn.ReadMessage()
+        conn.WriteMessage(websocket.TextMessage, []byte("OK"))
+    })
+    clock := &fakeClock{now: time.Unix(0, 0)}
+    client := NewMginDBClient("ws", host, port, withClock(clock), WithRetry(5, time.Minute))
+    updates, err := client.Subscribe("k")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if d := clock.waitStarted(t, 1); d != time.Minute {
+        t.Fatalf("redial backoff = %v, want 1m", d)
+    }
+
+    done := make(chan error, 1)
+    go func() {
+        _, err := client.Exec("INFO")
+        done <- err
+    }()
+    select {
+    case err := <-done:
+        if err == nil {
+            t.Fatal("Exec succeeded against a server that is down")
+        }
+    case <-time.After(2 * time.Second):
+        t.Fatal("Exec blocked behind the redial backoff")
+    }
+
+    closed := make(chan struct{})
+    go func() {
+        client.Close()
+        close(closed)
+    }()
+    select {
+    case <-closed:
+    case <-time.After(2 * time.Second):
+        t.Fatal("Close blocked behind the redial backoff")
+    }
+    if _, open := <-updates; open {
+        t.Fatal("subscription still open after Close")
+    }
+}
+
+func TestPoolWaitTimeoutOnFakeClock(t *testing.T) {
+    srv := mgindbtest.NewServer()
+    defer srv.Close()
+    clock := &fakeClock{now: time.Unix(0, 0)}
+    pool, err := NewPool(1, "ws", srv.Host(), srv.Port(), withClock(clock))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer pool.Close()
+    pool.WaitTimeout = time.Minute
+
+    ctx := context.Background()
+    if _, err := pool.Acquire(ctx); err != nil {
+        t.Fatal(err)
+    }
+    done := make(chan error, 1)
+    go func() {
+        _, err := pool.Acquire(ctx)
+        done <- err
+    }()
+    if d := clock.waitStarted(t, 1); d != time.Minute {
+        t.Fatalf("wait timer = %v, want 1m", d)
+    }
+    clock.Advance(time.Minute)
+    if err := <-done; !errors.Is(err, ErrPoolExhausted) {
+        t.Fatalf("Acquire = %v, want ErrPoolExhausted", err)
+    }
+}
+
+func TestKeysTheServerWouldRewrite(t *testing.T) {
+    srv, client := newTestServer(t)
+    for _, key := range []string{"", "two words", "a|b", "my-file"} {
+        if _, err := client.Set(key, "v"); !errors.Is(err, ErrInvalidKey) {
+            t.Errorf("Set(%q) = %v, want ErrInvalidKey", key, err)
+        }
+    }
+    if got := srv.Received(); len(got) != 0 {
+        t.Fatalf("invalid keys reached the server: %q", got)
+    }
+    if _, err := client.Set("my-key", "v"); err != nil {
+        t.Fatalf("Set(%q): %v", "my-key", err)
+    }
+}
+
+func TestSubscribePattern(t *testing.T) {
+    srv, client := newTestServer(t)
+    updates, err := client.SubscribePattern("user:*", WithCallTimeout(time.Second))
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv.Publish("user:1:name", `"ada"`)
+    select {
+    case msg := <-updates:
+        if msg.Key != "user:1:name" || string(msg.Data) != `"ada"` {
+            t.Fatalf("update = %s %s", msg.Key, msg.Data)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("no update for the pattern")
+    }
+    if _, err := client.UnsubscribePattern("user:*", WithCallTimeout(time.Second)); err != nil {
+        t.Fatal(err)
+    }
+    if _, open := <-updates; open {
+        t.Fatal("channel still open after UnsubscribePattern")
+    }
+}
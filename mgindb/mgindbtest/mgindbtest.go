@@ -0,0 +1,317 @@
+// Package mgindbtest provides an in-memory MginDB server for testing code
+// that uses the Go client, without a real server.
+//
+//	srv := mgindbtest.NewServer()
+//	defer srv.Close()
+//	client := NewMginDBClient("ws", srv.Host(), srv.Port())
+//
+// The server authenticates any credentials unless Credentials is called, and
+// answers SET, QUERY, COUNT, DEL, KEYS, SUB and UNSUB the way MginDB does for
+// plain keys. Any other command gets "None", like on the real server, unless
+// On scripts a reply for it. As on the server, a SET value has its UPPER,
+// LOWER and BASE64 calls evaluated before it is stored, and any other
+// name(arg) turns it into an "ERROR: Unsupported function" message.
+package mgindbtest
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// Welcome is the message the server sends once a client has authenticated.
+const Welcome = "MginDB server connected... Welcome!"
+
+type Server struct {
+    *httptest.Server
+
+    mutex    sync.Mutex
+    username string
+    password string
+    data     map[string]json.RawMessage
+    replies  map[string]string
+    received []string
+    subs     map[*session]map[string]bool
+}
+
+type session struct {
+    conn  *websocket.Conn
+    mutex sync.Mutex // serializes writes
+}
+
+func (s *session) write(message string) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    return s.conn.WriteMessage(websocket.TextMessage, []byte(message))
+}
+
+// NewServer starts a server on a loopback port. Close stops it.
+func NewServer() *Server {
+    s := &Server{
+        data:    make(map[string]json.RawMessage),
+        replies: make(map[string]string),
+        subs:    make(map[*session]map[string]bool),
+    }
+    s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+    return s
+}
+
+// Host and Port are the arguments to pass to NewMginDBClient, with "ws".
+func (s *Server) Host() string {
+    host, _, _ := net.SplitHostPort(s.Listener.Addr().String())
+    return host
+}
+
+func (s *Server) Port() int {
+    _, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+    n, _ := strconv.Atoi(port)
+    return n
+}
+
+// Credentials makes the server reject any other username and password.
+func (s *Server) Credentials(username, password string) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    s.username, s.password = username, password
+}
+
+// On scripts reply as the answer to every command exactly equal to command,
+// in place of the built-in handling.
+func (s *Server) On(command, reply string) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    s.replies[command] = reply
+}
+
+// Received returns every command received so far, in order. The Go client
+// follows each QUERY with a PING, which shows up here as well.
+func (s *Server) Received() []string {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    return append([]string(nil), s.received...)
+}
+
+// Seed stores value at key as if a client had sent SET key value.
+func (s *Server) Seed(key, value string) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    s.data[key] = decodeValue(value)
+}
+
+// Publish pushes data, which must be JSON, to the clients subscribed to key
+// or to a pattern matching it such as "user:*", once to each, in the envelope
+// the server uses for updates.
+func (s *Server) Publish(key string, data string) {
+    parts := strings.Split(key, ":")
+    patterns := []string{key}
+    for i := 1; i <= len(parts); i++ {
+        prefix := strings.Join(parts[:i], ":")
+        patterns = append(patterns, prefix+":*")
+        if i < len(parts) {
+            patterns = append(patterns, prefix+":*:*")
+        }
+    }
+
+    s.mutex.Lock()
+    var targets []*session
+    for sess, keys := range s.subs {
+        for _, pattern := range patterns {
+            if keys[pattern] {
+                targets = append(targets, sess)
+                break
+            }
+        }
+    }
+    s.mutex.Unlock()
+
+    message, _ := json.Marshal(map[string]interface{}{"key": key, "data": json.RawMessage(data)})
+    for _, sess := range targets {
+        sess.write(string(message))
+    }
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+    upgrader := websocket.Upgrader{}
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        return
+    }
+    defer conn.Close()
+    sess := &session{conn: conn}
+
+    _, message, err := conn.ReadMessage()
+    if err != nil {
+        return
+    }
+    if !s.authenticate(message) {
+        // Like the server, close with 1008 once the reason has been sent.
+        sess.write("Authentication failed: Incorrect username or password.")
+        conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""), time.Now().Add(time.Second))
+        return
+    }
+    sess.write(Welcome)
+
+    s.mutex.Lock()
+    s.subs[sess] = make(map[string]bool)
+    s.mutex.Unlock()
+    defer func() {
+        s.mutex.Lock()
+        delete(s.subs, sess)
+        s.mutex.Unlock()
+    }()
+
+    for {
+        _, message, err := conn.ReadMessage()
+        if err != nil {
+            return
+        }
+        if err := sess.write(s.handle(sess, string(message))); err != nil {
+            return
+        }
+    }
+}
+
+func (s *Server) authenticate(message []byte) bool {
+    var auth struct {
+        Username string `json:"username"`
+        Password string `json:"password"`
+    }
+    if err := json.Unmarshal(message, &auth); err != nil {
+        return false
+    }
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if s.username == "" && s.password == "" {
+        return true
+    }
+    return auth.Username == s.username && auth.Password == s.password
+}
+
+func (s *Server) handle(sess *session, command string) string {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    s.received = append(s.received, command)
+    if reply, ok := s.replies[command]; ok {
+        return reply
+    }
+
+    name, args, _ := strings.Cut(command, " ")
+    switch strings.ToUpper(name) {
+    case "SET":
+        var replies []string
+        for _, pair := range strings.Split(args, "|") {
+            key, value, ok := strings.Cut(strings.TrimSpace(pair), " ")
+            if !ok {
+                replies = append(replies, "ERROR: Invalid SET command format")
+                continue
+            }
+            s.data[key] = decodeValue(evaluate(value))
+            replies = append(replies, "OK")
+        }
+        return strings.Join(replies, "\n")
+    case "QUERY":
+        fields := strings.Fields(args)
+        if len(fields) == 0 {
+            return "[]"
+        }
+        value, ok := s.data[fields[0]]
+        if !ok {
+            return "[]"
+        }
+        reply, _ := json.Marshal([]map[string]json.RawMessage{{"value": value}})
+        return string(reply)
+    case "COUNT":
+        if _, ok := s.data[strings.TrimSpace(args)]; ok {
+            return "1"
+        }
+        return "0"
+    case "DEL":
+        var replies []string
+        for _, key := range strings.Split(args, "|") {
+            key = strings.TrimSpace(key)
+            if _, ok := s.data[key]; !ok {
+                replies = append(replies, "ERROR: Key does not exist")
+                continue
+            }
+            delete(s.data, key)
+            replies = append(replies, "OK")
+        }
+        return strings.Join(replies, "\n")
+    case "KEYS":
+        keys := make([]string, 0, len(s.data))
+        for key := range s.data {
+            keys = append(keys, key)
+        }
+        sort.Strings(keys)
+        reply, _ := json.Marshal(keys)
+        return string(reply)
+    case "SUB", "UNSUB":
+        subscribe := strings.EqualFold(name, "SUB")
+        for _, key := range strings.Split(args, ",") {
+            key = strings.TrimSpace(key)
+            if subscribe {
+                s.subs[sess][key] = true
+            } else {
+                delete(s.subs[sess], key)
+            }
+        }
+        return "OK"
+    }
+    return "None"
+}
+
+var functionCall = regexp.MustCompile(`(\w+)\(([^()]*?)\)`)
+
+// evaluate runs the expression functions in a SET value from the innermost
+// out, as the server does before decoding it.
+func evaluate(value string) string {
+    for {
+        match := functionCall.FindStringSubmatchIndex(value)
+        if match == nil {
+            return value
+        }
+        name := strings.ToUpper(value[match[2]:match[3]])
+        arg := strings.TrimSpace(value[match[4]:match[5]])
+        var result string
+        switch name {
+        case "UPPER":
+            result = strings.ToUpper(arg)
+        case "LOWER":
+            result = strings.ToLower(arg)
+        case "BASE64":
+            result = base64.StdEncoding.EncodeToString([]byte(arg))
+        default:
+            return "ERROR: Unsupported function " + name
+        }
+        value = value[:match[0]] + result + value[match[1]:]
+    }
+}
+
+// decodeValue stores a SET value the way the server does: JSON if it parses
+// as JSON, a string otherwise.
+func decodeValue(value string) json.RawMessage {
+    value = strings.TrimSpace(value)
+    if json.Valid([]byte(value)) {
+        return json.RawMessage(value)
+    }
+    quoted, _ := json.Marshal(value)
+    return quoted
+}
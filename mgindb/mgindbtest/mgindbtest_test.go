@@ -0,0 +1,131 @@
+package mgindbtest
+
+import (
+    "errors"
+    "testing"
+
+    "github.com/gorilla/websocket"
+)
+
+func dial(t *testing.T, srv *Server, login string) *websocket.Conn {
+    t.Helper()
+    conn, _, err := websocket.DefaultDialer.Dial("ws"+srv.URL[len("http"):], nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    if err := conn.WriteMessage(websocket.TextMessage, []byte(login)); err != nil {
+        t.Fatal(err)
+    }
+    return conn
+}
+
+func login(t *testing.T, srv *Server) *websocket.Conn {
+    t.Helper()
+    conn := dial(t, srv, `{"username":"u","password":"p"}`)
+    if got := read(t, conn); got != Welcome {
+        t.Fatalf("login reply = %q", got)
+    }
+    return conn
+}
+
+func read(t *testing.T, conn *websocket.Conn) string {
+    t.Helper()
+    _, message, err := conn.ReadMessage()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(message)
+}
+
+func send(t *testing.T, conn *websocket.Conn, command string) string {
+    t.Helper()
+    if err := conn.WriteMessage(websocket.TextMessage, []byte(command)); err != nil {
+        t.Fatal(err)
+    }
+    return read(t, conn)
+}
+
+func TestCommands(t *testing.T) {
+    srv := NewServer()
+    defer srv.Close()
+    conn := login(t, srv)
+
+    tests := []struct {
+        command, reply string
+    }{
+        {`SET a "x"|b 2`, "OK\nOK"},
+        {"SET c upper(x)", "OK"},
+        {"SET d call(me)", "OK"},
+        {"QUERY a", `[{"value":"x"}]`},
+        {"QUERY b WHERE value>1", `[{"value":2}]`},
+        {"QUERY c", `[{"value":"X"}]`},
+        {"QUERY d", `[{"value":"ERROR: Unsupported function CALL"}]`},
+        {"QUERY missing", "[]"},
+        {"QUERY", "[]"},
+        {"QUERY  ", "[]"},
+        {"COUNT a", "1"},
+        {"DEL a|missing", "OK\nERROR: Key does not exist"},
+        {"KEYS", `["b","c","d"]`},
+        {"INFO", "None"},
+    }
+    for _, tt := range tests {
+        if got := send(t, conn, tt.command); got != tt.reply {
+            t.Errorf("%s = %q, want %q", tt.command, got, tt.reply)
+        }
+    }
+}
+
+func TestOnAndReceived(t *testing.T) {
+    srv := NewServer()
+    defer srv.Close()
+    srv.On("INFO", "scripted")
+    conn := login(t, srv)
+
+    if got := send(t, conn, "INFO"); got != "scripted" {
+        t.Fatalf("INFO = %q", got)
+    }
+    send(t, conn, "COUNT a")
+    got := srv.Received()
+    if len(got) != 2 || got[0] != "INFO" || got[1] != "COUNT a" {
+        t.Fatalf("Received = %q", got)
+    }
+}
+
+func TestCredentials(t *testing.T) {
+    srv := NewServer()
+    defer srv.Close()
+    srv.Credentials("u", "p")
+    login(t, srv)
+
+    conn := dial(t, srv, `{"username":"u","password":"wrong"}`)
+    if got := read(t, conn); got != "Authentication failed: Incorrect username or password." {
+        t.Fatalf("login reply = %q", got)
+    }
+    _, _, err := conn.ReadMessage()
+    var closeErr *websocket.CloseError
+    if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+        t.Fatalf("after a failed login: %v, want a 1008 close", err)
+    }
+}
+
+func TestPublish(t *testing.T) {
+    srv := NewServer()
+    defer srv.Close()
+    exact, pattern, other := login(t, srv), login(t, srv), login(t, srv)
+    send(t, exact, "SUB user:1:name")
+    send(t, pattern, "SUB user:*")
+    send(t, other, "SUB order:*")
+
+    srv.Publish("user:1:name", `"ada"`)
+    want := `{"data":"ada","key":"user:1:name"}`
+    for _, conn := range []*websocket.Conn{exact, pattern} {
+        if got := read(t, conn); got != want {
+            t.Fatalf("push = %s, want %s", got, want)
+        }
+    }
+    // A reply proves no push reached the unrelated subscriber first.
+    if got := send(t, other, "COUNT a"); got != "0" {
+        t.Fatalf("unrelated subscriber read %q", got)
+    }
+}